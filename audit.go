@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a message whose forwarded bytes differ from the bytes that were received
+type AuditEntry struct {
+	// Time is when the message was forwarded
+	Time time.Time `json:"time"`
+
+	// Source is the side that sent the message, either "CLIENT" or "SERVER"
+	Source string `json:"source"`
+
+	// Reasons are the features of the proxy that changed the message
+	Reasons []string `json:"reasons"`
+
+	// Original are the raw bytes received from the source
+	Original []byte `json:"original"`
+
+	// Forwarded are the raw bytes sent to the other side
+	Forwarded []byte `json:"forwarded"`
+}
+
+// auditMutex serializes the writes to the audit file, as sessions run concurrently
+var auditMutex sync.Mutex
+
+// auditWriter writes a forwarded message to the other side, and keeps the bytes written for
+// auditForward. The bytes aren't copied: the message is written from a single buffer, retried
+// with what's left of it after a short write, so the first buffer holds the whole message
+type auditWriter struct {
+	writer io.Writer
+
+	// written are the bytes passed on to the writer
+	written []byte
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if w.written == nil {
+		w.written = p[:n]
+	} else {
+		w.written = w.written[:len(w.written)+n]
+	}
+	return n, err
+}
+
+// auditForward compares the bytes received from a side with the bytes that were forwarded,
+// and records the change if they differ. reasons are the features that knowingly modified the
+// message. Any other difference comes from parsing and serializing the message again. The
+// differences between both messages are logged, so that a change is visible without the report.
+//
+// This is called for every forwarded message, so nothing can change the traffic without
+// leaving a trace. The entries are appended to the file set in the PONSE_AUDIT_FILE env
+func auditForward(source string, original, forwarded []byte, reasons []string) {
+	if bytes.Equal(original, forwarded) {
+		return
+	}
+
+	if len(reasons) == 0 {
+		reasons = []string{"re-serialization"}
+	}
+
+	log.Printf("[AUDIT] %s message changed by %s\n", source, strings.Join(reasons, ", "))
+	if diff := diffForwarded(original, forwarded); len(diff) > 0 {
+		log.Printf("[AUDIT] %s message differences:\n%s\n", source, diff.Unified("received", "forwarded"))
+	}
+
+	path := os.Getenv("PONSE_AUDIT_FILE")
+	if path == "" {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:      time.Now(),
+		Source:    source,
+		Reasons:   reasons,
+		Original:  original,
+		Forwarded: forwarded,
+	}
+
+	if err := appendAuditEntry(path, entry); err != nil {
+		log.Printf("[AUDIT] Failed to write %s: %v\n", path, err)
+	}
+}
+
+// diffForwarded returns the differences between the message received and the message forwarded.
+// It's empty if either can't be parsed, or if only the line endings differ
+func diffForwarded(original, forwarded []byte) MessageDiff {
+	received, err := NewMessage(original)
+	if err != nil {
+		return nil
+	}
+
+	sent, err := NewMessage(forwarded)
+	if err != nil {
+		return nil
+	}
+
+	return Diff(received, sent)
+}
+
+// appendAuditEntry writes an entry as a single JSON line at the end of the audit file
+func appendAuditEntry(path string, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// printAuditReport prints every mutation recorded in an audit file, with a line diff between
+// the original and the forwarded message
+func printAuditReport(path string) error {
+	count := 0
+	err := scanAuditFile(path, func(entry AuditEntry) error {
+		count++
+		fmt.Printf("%s %s message changed by %s\n", entry.Time.Format(time.RFC3339Nano), entry.Source, strings.Join(entry.Reasons, ", "))
+		for _, line := range diffLines(splitLines(entry.Original), splitLines(entry.Forwarded)) {
+			fmt.Printf("  %s\n", line)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d mutations\n", count)
+	return nil
+}
+
+// scanAuditFile calls fn with each entry of an audit file, in the order they were written
+func scanAuditFile(path string, fn func(AuditEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitLines splits a raw message into its lines, quoting them so that control characters
+// and line endings are visible
+func splitLines(message []byte) []string {
+	lines := strings.SplitAfter(string(message), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, line := range lines {
+		lines[i] = fmt.Sprintf("%q", line)
+	}
+
+	return lines
+}
+
+// diffLines returns a line diff between two messages. Removed lines start with "-", added
+// lines with "+" and unchanged lines with a space
+func diffLines(a, b []string) []string {
+	// Longest common subsequence table, where lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	diff := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+
+	return diff
+}
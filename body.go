@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"unicode"
+)
+
+// BodyDelimiter determines where the body of a message starts. Bodies were only seen in a few
+// captures, so the delimiter is configurable until it's confirmed
+type BodyDelimiter int
+
+const (
+	// BodyAfterBlankLine starts the body after the first empty line following the method line,
+	// like in HTTP. The empty line is part of neither the headers nor the body
+	BodyAfterBlankLine BodyDelimiter = iota
+
+	// BodyAfterHeaders starts the body at the first line that can't be a header: an empty line,
+	// or a line with a control character other than a tab, like binary data
+	BodyAfterHeaders
+)
+
+// bodyDelimiter is the BodyDelimiter used when parsing and serializing messages
+var bodyDelimiter = BodyAfterBlankLine
+
+// bodyPreviewSize is the number of bytes of a body shown in the logs
+const bodyPreviewSize = 16
+
+// startsBody returns whether a line following the method line starts the body, following
+// bodyDelimiter, and whether the line is the delimiter, which is part of neither the headers nor
+// the body
+func startsBody(line []byte) (bool, bool) {
+	if bodyDelimiter == BodyAfterHeaders {
+		return len(line) == 0 || bytes.ContainsFunc(line, isBodyCharacter), false
+	}
+
+	return len(line) == 0, true
+}
+
+// isBodyCharacter returns whether a character can't be part of a header line
+func isBodyCharacter(r rune) bool {
+	return r != '\t' && unicode.IsControl(r)
+}
+
+// bodyPreview returns the first bytes of a body in hex, like "1f8b0800..."
+func bodyPreview(body []byte) string {
+	if len(body) <= bodyPreviewSize {
+		return hex.EncodeToString(body)
+	}
+
+	return hex.EncodeToString(body[:bodyPreviewSize]) + "..."
+}
+
+// logBody logs the size and the first bytes of the body of a message read by the proxy, if it
+// has one. The body is forwarded as received
+func logBody(msg *Message) {
+	if msg.Body == nil {
+		return
+	}
+
+	log.Printf("[%s] %s body of %d bytes: %s\n", msg.Direction, msg.Method, len(msg.Body), bodyPreview(msg.Body))
+}
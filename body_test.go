@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBody(t *testing.T) {
+	defer func(delimiter BodyDelimiter) { bodyDelimiter = delimiter }(bodyDelimiter)
+
+	binary := "\x1f\x8b\x08\x00\x00\x00\x00\x00\r\n"
+	tests := []struct {
+		name      string
+		delimiter BodyDelimiter
+		raw       string
+		headers   int
+		body      []byte
+	}{
+		{"no body", BodyAfterBlankLine, testMessages[1], 3, nil},
+		{"after a blank line", BodyAfterBlankLine, "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nt=1\r\n\r\nline=1\r\nline 2\r\nSubmit\r\n", 1, []byte("line=1\r\nline 2\r\n")},
+		{"empty after a blank line", BodyAfterBlankLine, "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nt=1\r\n\r\nSubmit\r\n", 1, []byte{}},
+		{"binary after the headers", BodyAfterHeaders, "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nt=1\r\n" + binary + "Submit\r\n", 1, []byte(binary)},
+		{"binary kept as headers", BodyAfterBlankLine, "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nt=1\r\n" + binary + "Submit\r\n", 2, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bodyDelimiter = test.delimiter
+			msg, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Headers.Len() != test.headers {
+				t.Errorf("headers = %s, want %d", msg.Headers, test.headers)
+			}
+			if (msg.Body == nil) != (test.body == nil) || !bytes.Equal(msg.Body, test.body) {
+				t.Errorf("Body = %q, want %q", msg.Body, test.body)
+			}
+
+			// The body is forwarded as received, even when the headers are changed
+			if err := msg.Headers.Set("t", "2"); err != nil {
+				t.Fatal(err)
+			}
+			again, err := NewMessage(msg.ToBytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again.Body, test.body) || again.Headers.Get("t") != "2" {
+				t.Errorf("after a round trip, body = %q and t=%s, want %q and t=2", again.Body, again.Headers.Get("t"), test.body)
+			}
+		})
+	}
+}
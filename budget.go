@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BudgetState is the persisted state of the upstream connection budget
+type BudgetState struct {
+	// Attempts are the times of the upstream control connection attempts in the last day
+	Attempts []time.Time `json:"attempts"`
+
+	// OverrideUntil lifts the limits until the given time
+	OverrideUntil time.Time `json:"override_until"`
+}
+
+// budgetMutex serializes the updates to the budget file, as sessions start concurrently
+var budgetMutex sync.Mutex
+
+// budgetPath returns the path of the budget file. It can be set with the PONSE_BUDGET_FILE
+// env, and defaults to budget.json in the state directory
+func budgetPath() (string, error) {
+	return stateFile("PONSE_BUDGET_FILE", "budget.json")
+}
+
+// budgetLimits returns the maximum number of upstream attempts per hour and per day, read from
+// the PONSE_MAX_ATTEMPTS_HOUR and PONSE_MAX_ATTEMPTS_DAY envs. Zero means no limit
+func budgetLimits() (int, int, error) {
+	limits := make([]int, 2)
+	for i, env := range []string{"PONSE_MAX_ATTEMPTS_HOUR", "PONSE_MAX_ATTEMPTS_DAY"} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", env, err)
+		}
+		limits[i] = limit
+	}
+
+	return limits[0], limits[1], nil
+}
+
+// loadBudget reads the budget file, dropping the attempts older than a day. A missing file is
+// an empty budget
+func loadBudget() (*BudgetState, error) {
+	state := &BudgetState{}
+
+	path, err := budgetPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, err
+		}
+	}
+
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	recent := state.Attempts[:0]
+	for _, attempt := range state.Attempts {
+		if attempt.After(dayAgo) {
+			recent = append(recent, attempt)
+		}
+	}
+	state.Attempts = recent
+
+	return state, nil
+}
+
+// saveBudget writes the budget file through a temporary file, like the upstream history
+func saveBudget(state *BudgetState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := budgetPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// attemptsSince counts the attempts made after the given time
+func (s *BudgetState) attemptsSince(since time.Time) int {
+	count := 0
+	for _, attempt := range s.Attempts {
+		if attempt.After(since) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// reserveUpstreamAttempt checks the budget before dialing the upstream, and counts the attempt
+// if it's allowed. Sessions are metered by the server, so a proxy reconnecting in a loop could
+// use up the play time quickly. The returned error wraps ErrBudgetExceeded if the attempt
+// isn't allowed
+func reserveUpstreamAttempt() error {
+	hourLimit, dayLimit, err := budgetLimits()
+	if err != nil {
+		return err
+	}
+
+	// Without limits there is nothing to keep track of
+	if hourLimit == 0 && dayLimit == 0 {
+		return nil
+	}
+
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+
+	state, err := loadBudget()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.After(state.OverrideUntil) {
+		if hourLimit > 0 && state.attemptsSince(now.Add(-time.Hour)) >= hourLimit {
+			return fmt.Errorf("%w: %d attempts in the last hour", ErrBudgetExceeded, hourLimit)
+		}
+		if dayLimit > 0 && len(state.Attempts) >= dayLimit {
+			return fmt.Errorf("%w: %d attempts in the last day", ErrBudgetExceeded, dayLimit)
+		}
+	}
+
+	state.Attempts = append(state.Attempts, now)
+	return saveBudget(state)
+}
+
+// overrideBudget lifts the budget limits for the next hour
+func overrideBudget() error {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+
+	state, err := loadBudget()
+	if err != nil {
+		return err
+	}
+
+	state.OverrideUntil = time.Now().Add(time.Hour)
+	if err := saveBudget(state); err != nil {
+		return err
+	}
+
+	fmt.Printf("Budget limits lifted until %s\n", state.OverrideUntil.Format(time.RFC3339))
+	return nil
+}
+
+// printBudgetStatus prints the attempts made and the remaining budget
+func printBudgetStatus() error {
+	hourLimit, dayLimit, err := budgetLimits()
+	if err != nil {
+		return err
+	}
+
+	state, err := loadBudget()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	hourAttempts := state.attemptsSince(now.Add(-time.Hour))
+	dayAttempts := len(state.Attempts)
+
+	fmt.Printf("Last hour: %s\n", describeBudget(hourAttempts, hourLimit))
+	fmt.Printf("Last day: %s\n", describeBudget(dayAttempts, dayLimit))
+	if now.Before(state.OverrideUntil) {
+		fmt.Printf("Limits lifted until %s\n", state.OverrideUntil.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// describeBudget formats the attempts made against a limit
+func describeBudget(attempts, limit int) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d attempts, no limit", attempts)
+	}
+
+	return fmt.Sprintf("%d/%d attempts, %d remaining", attempts, limit, max(limit-attempts, 0))
+}
@@ -0,0 +1,54 @@
+package main
+
+import "sync/atomic"
+
+// DefaultVersion is the iRTSP version of the messages built by NewRequest and NewResponse
+const DefaultVersion = "iRTSP/1.21"
+
+// Header is a header field given to NewRequest and NewResponse. A bare header, like the "sc"
+// flag, is written without an equal sign
+type Header struct {
+	Key   string
+	Value string
+	Bare  bool
+}
+
+// NewRequest builds a request with the default version, like the START request of the Message
+// example:
+//
+//	NewRequest(MethodStart, Header{Key: HeaderScheme, Bare: true}, Header{Key: HeaderTime, Value: "1429051"})
+//
+// The sequence number is zero, use a SequenceGenerator to number the messages of a connection
+func NewRequest(method string, headers ...Header) *Message {
+	msg := &Message{Version: DefaultVersion, Method: method, Complete: true}
+	for _, header := range headers {
+		msg.Headers.add(HeaderLine{Key: header.Key, Value: header.Value, HasValue: !header.Bare})
+	}
+
+	return msg
+}
+
+// NewResponse builds a response with the default version, like NewRequest
+func NewResponse(method string, code int, headers ...Header) *Message {
+	msg := NewRequest(method, headers...)
+	msg.Type = MessageResponse
+	msg.Code = code
+	return msg
+}
+
+// SequenceGenerator numbers the messages sent on a connection, starting at zero. It can be used
+// from several goroutines
+type SequenceGenerator struct {
+	next atomic.Int64
+}
+
+// Next returns the next sequence number
+func (g *SequenceGenerator) Next() int {
+	return int(g.next.Add(1) - 1)
+}
+
+// Stamp sets the next sequence number on a message, and returns the message
+func (g *SequenceGenerator) Stamp(msg *Message) *Message {
+	msg.Sequence = g.Next()
+	return msg
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func ExampleNewRequest() {
+	var sequence SequenceGenerator
+
+	// The START request of the Message example
+	start := sequence.Stamp(NewRequest(MethodStart, Header{Key: HeaderScheme, Bare: true}, Header{Key: HeaderTime, Value: "1429051"}))
+	fmt.Printf("%q\n", start.ToBytes())
+
+	options := sequence.Stamp(NewRequest(MethodOptions))
+	fmt.Printf("%q\n", options.ToBytes())
+	// Output:
+	// "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\nSubmit\r\n"
+	// "iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nSubmit\r\n"
+}
+
+func ExampleNewResponse() {
+	setup := NewResponse(MethodSetup, 200, Header{Key: HeaderVideo, Value: "iDataChunk/unicast/tcp/40603"})
+	setup.Sequence = 1
+	fmt.Printf("%q\n", setup.ToBytes())
+	// Output:
+	// "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nv=iDataChunk/unicast/tcp/40603\r\nSubmit\r\n"
+}
+
+func TestBuilderMatchesTraffic(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+		raw  string
+	}{
+		{"START request", NewRequest(MethodStart, Header{Key: HeaderScheme, Value: "tls"}, Header{Key: HeaderTime, Value: "1429051"}), testMessages[0]},
+		{"KNOCK response", NewResponse(MethodKnock, 200, Header{Key: HeaderKnockPort, Value: "iDataChunk/unicast/tcp/40607;"}), testMessages[2]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.msg.Sequence = parsed.Sequence
+
+			if got := string(test.msg.ToBytes()); got != test.raw {
+				t.Errorf("ToBytes() = %q, want %q", got, test.raw)
+			}
+			if diff := Diff(parsed, test.msg); len(diff) > 0 {
+				t.Errorf("built message differs from the parsed one:\n%s", diff.Unified("parsed", "built"))
+			}
+		})
+	}
+}
+
+func TestSequenceGeneratorConcurrent(t *testing.T) {
+	var sequence SequenceGenerator
+	seen := make([]bool, 1000)
+
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < len(seen)/10; j++ {
+				n := sequence.Next()
+				mutex.Lock()
+				seen[n] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+
+	for n, ok := range seen {
+		if !ok {
+			t.Fatalf("sequence number %d wasn't given out", n)
+		}
+	}
+}
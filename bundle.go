@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// secretEnvHints are the parts of an env name that mark its value as secret
+var secretEnvHints = []string{"KEY", "SECRET", "TOKEN", "PASSWORD"}
+
+// bundleLogTags are the tags of the log lines counted in the anomaly summary of the bundle
+var bundleLogTags = []string{"[ANOMALY]", "[SECURITY]", "[AUDIT]", "WARNING:"}
+
+// createBundle gathers what's useful for a bug report about a session into a single tar.gz:
+// the effective configuration with the secrets masked, the build info, the session record with
+// its statistics, the lines logged during the session, a summary of the anomalies logged, the
+// audit entries of the session without the messages, and the upstream history and budget
+// files if they exist. The selector is the session ID or "last". It returns the path of the
+// bundle
+func createBundle(selector string) (string, error) {
+	records, err := loadSessionRecords()
+	if err != nil {
+		return "", err
+	}
+
+	selected, err := selectSessionRecords(records, selector)
+	if err != nil {
+		return "", err
+	}
+
+	var sessionLog []string
+	for _, record := range selected {
+		sessionLog = append(sessionLog, record.Log...)
+	}
+
+	audit, err := describeSessionAudit(selected)
+	if err != nil {
+		return "", err
+	}
+
+	files := []struct {
+		name string
+		data string
+	}{
+		{"config.txt", describeConfig()},
+		{"build.txt", describeBuild()},
+		{"session.txt", describeSessionRecords(selected)},
+		{"session.log", strings.Join(sessionLog, "\n") + "\n"},
+		{"anomalies.txt", describeAnomalies(sessionLog)},
+		{"audit.txt", audit},
+	}
+
+	path := fmt.Sprintf("ponse-bundle-session%d-%s.tar.gz", selected[0].LogicalID, time.Now().Format("20060102-150405"))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, bundled := range files {
+		if err := addBundleFile(tarWriter, bundled.name, []byte(redactSecrets(bundled.data))); err != nil {
+			return "", err
+		}
+	}
+
+	// The state files are optional, as each feature only writes them when it's used
+	for _, statePath := range []func() (string, error){historyPath, budgetPath} {
+		stateFile, err := statePath()
+		if err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(stateFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if err := addBundleFile(tarWriter, filepath.Base(stateFile), data); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// describeSessionRecords describes the connections of a session and their statistics
+func describeSessionRecords(records []SessionRecord) string {
+	builder := &strings.Builder{}
+	for _, record := range records {
+		builder.WriteString(fmt.Sprintf("Connection %d of session %d\n", record.ID, record.LogicalID))
+		builder.WriteString(fmt.Sprintf("  client: %s on %s\n", record.Client, record.Listener))
+		builder.WriteString(fmt.Sprintf("  upstream: %s\n", record.Upstream))
+		builder.WriteString(fmt.Sprintf("  time: %s to %s (%s)\n", record.Start.Format(time.RFC3339), record.End.Format(time.RFC3339), record.End.Sub(record.Start).Round(time.Millisecond)))
+		builder.WriteString(fmt.Sprintf("  end reason: %s\n", record.EndReason))
+		if record.Error != "" {
+			builder.WriteString(fmt.Sprintf("  error: %s\n", record.Error))
+		}
+		builder.WriteString(fmt.Sprintf("  summary: %s\n", record.Summary))
+		for _, line := range record.Stats {
+			builder.WriteString(fmt.Sprintf("  %s\n", line))
+		}
+	}
+
+	return builder.String()
+}
+
+// describeAnomalies counts the log lines of each of the bundleLogTags, then lists them
+func describeAnomalies(lines []string) string {
+	counts := make(map[string]int)
+	var tagged []string
+	for _, line := range lines {
+		for _, tag := range bundleLogTags {
+			if strings.Contains(line, tag) {
+				counts[tag]++
+				tagged = append(tagged, line)
+				break
+			}
+		}
+	}
+
+	builder := &strings.Builder{}
+	for _, tag := range bundleLogTags {
+		builder.WriteString(fmt.Sprintf("%s %d\n", tag, counts[tag]))
+	}
+	if len(tagged) > 0 {
+		builder.WriteString("\n" + strings.Join(tagged, "\n") + "\n")
+	}
+
+	return builder.String()
+}
+
+// describeSessionAudit lists the entries of the PONSE_AUDIT_FILE written during the sessions.
+// The messages aren't included, only the parts that changed, without their values
+func describeSessionAudit(records []SessionRecord) (string, error) {
+	path := os.Getenv("PONSE_AUDIT_FILE")
+	if path == "" {
+		return "no audit file\n", nil
+	}
+
+	builder := &strings.Builder{}
+	count := 0
+	err := scanAuditFile(path, func(entry AuditEntry) error {
+		for _, record := range records {
+			if entry.Time.Before(record.Start) || entry.Time.After(record.End) {
+				continue
+			}
+
+			count++
+			builder.WriteString(fmt.Sprintf("%s %s message changed by %s\n", entry.Time.Format(time.RFC3339Nano), entry.Source, strings.Join(entry.Reasons, ", ")))
+			for _, difference := range diffForwarded(entry.Original, entry.Forwarded) {
+				builder.WriteString("  " + describeRedacted(difference) + "\n")
+			}
+			break
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return "no audit file\n", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	builder.WriteString(fmt.Sprintf("%d mutations\n", count))
+	return builder.String(), nil
+}
+
+// describeRedacted describes a difference without the values it changed, like "changed header sc"
+func describeRedacted(difference Difference) string {
+	if difference.Key == "" {
+		return fmt.Sprintf("%s %s", difference.Kind, difference.Field)
+	}
+
+	return fmt.Sprintf("%s %s %s", difference.Kind, difference.Field, difference.Key)
+}
+
+// redactSecrets masks the values of the secret PONSE_ envs wherever they appear in the text
+func redactSecrets(text string) string {
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "PONSE_") && value != "" && isSecretEnv(name) {
+			text = strings.ReplaceAll(text, value, "********")
+		}
+	}
+
+	return text
+}
+
+// isSecretEnv returns whether the name of an env marks its value as secret
+func isSecretEnv(name string) bool {
+	for _, hint := range secretEnvHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addBundleFile adds a file with the given contents to the bundle
+func addBundleFile(tarWriter *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tarWriter.Write(data)
+	return err
+}
+
+// describeConfig lists the PONSE_ envs in effect, masking the values of the ones that look secret
+func describeConfig() string {
+	var lines []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, "PONSE_") {
+			continue
+		}
+
+		if isSecretEnv(name) {
+			value = "********"
+		}
+
+		lines = append(lines, name+"="+value)
+	}
+	slices.Sort(lines)
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// describeBuild returns the Go version, the platform and the module build info
+func describeBuild() string {
+	builder := &strings.Builder{}
+	builder.WriteString(fmt.Sprintf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH))
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		builder.WriteString(info.String())
+	}
+
+	return builder.String()
+}
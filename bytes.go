@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// ByteCounter counts the bytes read from and written to a connection
+type ByteCounter struct {
+	Read    atomic.Int64
+	Written atomic.Int64
+}
+
+// ChannelBytes counts the bytes of a control connection at two layers: on the wire, including
+// the TLS records and handshakes, and as read and written by the proxy once decrypted. Both are
+// the same as long as the connection is in plain text
+type ChannelBytes struct {
+	Wire ByteCounter
+	App  ByteCounter
+
+	// Messages counts the messages read, and MessageBytes their size. The bytes of a message are
+	// counted when its last byte is read, whichever reads it came in
+	Messages     atomic.Int64
+	MessageBytes atomic.Int64
+}
+
+// recordMessage counts a message read from the connection
+func (c *ChannelBytes) recordMessage(frame Frame) {
+	c.Messages.Add(1)
+	c.MessageBytes.Add(int64(frame.Size))
+}
+
+// Describe formats the counts of both directions, with the share of the wire bytes that is TLS
+// overhead
+func (c *ChannelBytes) Describe() string {
+	return fmt.Sprintf("read wire=%d app=%d (%s overhead) in %d messages of %d bytes, written wire=%d app=%d (%s overhead)",
+		c.Wire.Read.Load(), c.App.Read.Load(), describeOverhead(c.Wire.Read.Load(), c.App.Read.Load()), c.Messages.Load(), c.MessageBytes.Load(),
+		c.Wire.Written.Load(), c.App.Written.Load(), describeOverhead(c.Wire.Written.Load(), c.App.Written.Load()))
+}
+
+// describeOverhead formats the share of the wire bytes that didn't reach the application
+func describeOverhead(wire, app int64) string {
+	if wire == 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%.1f%%", float64(wire-app)/float64(wire)*100)
+}
+
+// countingConn counts the bytes going through a connection. It wraps the raw connection to
+// count the wire bytes, and the TLS connection on top of it to count the application bytes
+type countingConn struct {
+	net.Conn
+	counter *ByteCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.Read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.Written.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultCertWarnWindow is how long before its expiry the certificate is warned about, if
+// PONSE_CERT_WARN_WINDOW isn't set
+const defaultCertWarnWindow = 14 * 24 * time.Hour
+
+// certWarnWindow returns the certificate warning window, set with the PONSE_CERT_WARN_WINDOW env
+// as a Go duration
+func certWarnWindow() time.Duration {
+	if window := envDuration("PONSE_CERT_WARN_WINDOW"); window > 0 {
+		return window
+	}
+
+	return defaultCertWarnWindow
+}
+
+// checkCertificate logs the subject, names and validity of the certificate used with the client,
+// and warns when it isn't valid yet, has expired or expires within the warning window. The 3DS
+// doesn't verify the certificate, but other tools connecting to the proxy do
+func checkCertificate(cer tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse server.crt: %w", err)
+	}
+
+	names := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	log.Printf("Certificate: subject=%q SANs=[%s] notBefore=%s notAfter=%s\n", leaf.Subject.String(), strings.Join(names, ", "),
+		leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+
+	now := time.Now()
+	var message string
+	switch {
+	case now.Before(leaf.NotBefore):
+		message = fmt.Sprintf("server.crt isn't valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	case now.After(leaf.NotAfter):
+		message = fmt.Sprintf("server.crt expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < certWarnWindow():
+		days := int(leaf.NotAfter.Sub(now).Hours() / 24)
+		message = fmt.Sprintf("server.crt expires on %s (%d days left)", leaf.NotAfter.Format(time.RFC3339), days)
+	default:
+		return nil
+	}
+
+	log.Printf("WARNING: %s\n", message)
+	notify(EventCertExpiring, message)
+	return nil
+}
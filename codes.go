@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Response codes used by the proxy. Only 200 was seen from the server so far, the error codes of
+// iRTSP being unknown, so the proxy's own error responses use the RTSP ones
+const (
+	// CodeOK answers a request that succeeded
+	CodeOK = 200
+
+	// CodeServiceUnavailable is the RTSP "Service Unavailable" code, answered by the proxy to a
+	// client it can't serve
+	CodeServiceUnavailable = 503
+)
+
+// ResponseCode is what the proxy knows about a response code. The known codes are listed in
+// protocol.json, where a code seen from the server can be added once its meaning is known
+type ResponseCode struct {
+	// Name is the reason phrase of the code, like "OK"
+	Name string `json:"name,omitempty"`
+
+	// Error is set for the codes telling that the request failed
+	Error bool `json:"error,omitempty"`
+}
+
+// errorCodeRange is the first code of the range classified as errors, for the codes the proxy
+// doesn't know
+const errorCodeRange = 400
+
+// responseCode returns what the proxy knows about a code, and whether it's one of the known
+// codes. An unknown code is classified by range: 2xx is a success, 4xx and above are errors
+func responseCode(code int) (ResponseCode, bool) {
+	if definition, ok := protocolDefinition(KindCode, strconv.Itoa(code)); ok {
+		return definition.ResponseCode, true
+	}
+
+	return ResponseCode{Error: code >= errorCodeRange}, false
+}
+
+// describeCode returns a code with its name for logs, like "200 OK", or "450 (unrecognized)" for
+// a code the proxy doesn't know
+func describeCode(code int) string {
+	known, ok := responseCode(code)
+	if !ok {
+		return fmt.Sprintf("%d (unrecognized)", code)
+	}
+
+	return fmt.Sprintf("%d %s", code, known.Name)
+}
+
+// IsSuccess returns whether the message is a response telling that the request succeeded
+func (m *Message) IsSuccess() bool {
+	if !m.IsResponse() {
+		return false
+	}
+
+	known, ok := responseCode(m.Code)
+	if !ok {
+		return m.Code >= 200 && m.Code < 300
+	}
+
+	return !known.Error
+}
+
+// IsError returns whether the message is a response telling that the request failed
+func (m *Message) IsError() bool {
+	if !m.IsResponse() {
+		return false
+	}
+
+	known, _ := responseCode(m.Code)
+	return known.Error
+}
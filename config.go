@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// deprecatedEnvs maps the envs that were renamed to their new name. The old names keep working
+// with the same meaning, but a warning is logged when they are used
+var deprecatedEnvs = map[string]string{
+	"PONSE_DISABLE_TLS": "PONSE_CLIENT_PLAINTEXT",
+}
+
+// warnDeprecatedEnvs logs every deprecated env that is set, with the name to use instead. An
+// empty env is unset, like everywhere else in the configuration
+func warnDeprecatedEnvs() {
+	names := make([]string, 0, len(deprecatedEnvs))
+	for name := range deprecatedEnvs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if os.Getenv(name) != "" {
+			log.Printf("WARNING: %s is deprecated, use %s instead\n", name, deprecatedEnvs[name])
+		}
+	}
+}
+
+// clientPlaintextEnabled returns whether the client plaintext mode is set, with
+// PONSE_CLIENT_PLAINTEXT or its deprecated alias PONSE_DISABLE_TLS. Like before the rename, any
+// value enables it
+func clientPlaintextEnabled() bool {
+	return os.Getenv("PONSE_CLIENT_PLAINTEXT") != "" || os.Getenv("PONSE_DISABLE_TLS") != ""
+}
+
+// stateFile returns the path of a file the proxy keeps across restarts: the value of the env if
+// it's set, or the file of the given name in the ponse directory of the user cache directory, so
+// that it doesn't depend on where the proxy is started from
+func stateFile(env, name string) (string, error) {
+	if path := os.Getenv(env); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("%s isn't set: %w", env, err)
+	}
+
+	return filepath.Join(dir, "ponse", name), nil
+}
+
+// migrateConfig returns the PONSE_ envs in effect (from the environment and the .env file) as a
+// .env file, with the deprecated names replaced by the new ones. When both names are set, the
+// new one is kept
+func migrateConfig() (string, error) {
+	envs := make(map[string]string)
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "PONSE_") {
+			envs[name] = value
+		}
+	}
+
+	for name, newName := range deprecatedEnvs {
+		value, ok := envs[name]
+		if !ok {
+			continue
+		}
+		delete(envs, name)
+
+		if _, ok := envs[newName]; !ok {
+			envs[newName] = value
+		}
+	}
+
+	return godotenv.Marshal(envs)
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+// TestLegacyConfig pins the behavior of the envs scripts were written against before the
+// configuration grew: the proxy listens on the port of the server, and the TLS scheme is only
+// cleared for the client when PONSE_DISABLE_TLS is set, to any value
+func TestLegacyConfig(t *testing.T) {
+	defer func(network, control, address, port string, plaintext bool) {
+		serverNetwork, serverControlAddress, serverAddress, serverPort, clientPlaintext = network, control, address, port, plaintext
+	}(serverNetwork, serverControlAddress, serverAddress, serverPort, clientPlaintext)
+
+	tests := []struct {
+		name      string
+		uri       string
+		envs      map[string]string
+		listen    string
+		plaintext bool
+	}{
+		{"server URI", "irtsp://140.227.187.170:41002", nil, ":41002", false},
+		{"server URI without scheme", "140.227.187.170:41002", nil, ":41002", false},
+		{"PONSE_DISABLE_TLS", "irtsp://140.227.187.170:41002", map[string]string{"PONSE_DISABLE_TLS": "1"}, ":41002", true},
+		{"PONSE_DISABLE_TLS=0", "irtsp://140.227.187.170:41002", map[string]string{"PONSE_DISABLE_TLS": "0"}, ":41002", true},
+		{"PONSE_CLIENT_PLAINTEXT", "irtsp://140.227.187.170:41002", map[string]string{"PONSE_CLIENT_PLAINTEXT": "1"}, ":41002", true},
+		{"PONSE_LISTEN_ADDR", "irtsp://140.227.187.170:41002", map[string]string{"PONSE_LISTEN_ADDR": "127.0.0.1:5000"}, "127.0.0.1:5000", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, env := range []string{"PONSE_DISABLE_TLS", "PONSE_CLIENT_PLAINTEXT", "PONSE_LISTEN_ADDR"} {
+				t.Setenv(env, test.envs[env])
+			}
+
+			setServerURI(test.uri)
+			listen, err := listenAddressList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if listen != test.listen {
+				t.Errorf("listen address = %q, want %q", listen, test.listen)
+			}
+
+			clientPlaintext = clientPlaintextEnabled()
+			if clientPlaintext != test.plaintext {
+				t.Errorf("client plaintext = %v, want %v", clientPlaintext, test.plaintext)
+			}
+
+			start, err := NewMessage([]byte(testMessages[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			forward, cleared := plaintextForClient(start)
+			wantScheme := SchemeTLS
+			if test.plaintext {
+				wantScheme = SchemeNone
+			}
+			if forward.Scheme() != wantScheme || cleared != test.plaintext {
+				t.Errorf("START forwarded with sc %s (cleared=%v), want %s", forward.Scheme(), cleared, wantScheme)
+			}
+			if start.Scheme() != SchemeTLS {
+				t.Errorf("START as received changed to sc %s", start.Scheme())
+			}
+		})
+	}
+}
+
+func TestListenAddressUnixServer(t *testing.T) {
+	defer func(network, control, address, port string) {
+		serverNetwork, serverControlAddress, serverAddress, serverPort = network, control, address, port
+	}(serverNetwork, serverControlAddress, serverAddress, serverPort)
+	t.Setenv("PONSE_LISTEN_ADDR", "")
+
+	setServerURI("unix:///tmp/server.sock")
+	if serverNetwork != "unix" || serverControlAddress != "/tmp/server.sock" || serverAddress != "127.0.0.1" {
+		t.Errorf("server = %s %s, media to %s", serverNetwork, serverControlAddress, serverAddress)
+	}
+	if _, err := listenAddressList(); err == nil {
+		t.Error("listenAddressList() = nil error, want PONSE_LISTEN_ADDR to be required")
+	}
+}
+
+// TestPlaintextForClient checks the changes of the client plaintext mode over the legacy
+// PONSE_DISABLE_TLS: a TLS scheme is cleared on every message, not only START
+func TestPlaintextForClient(t *testing.T) {
+	defer func(plaintext bool) { clientPlaintext = plaintext }(clientPlaintext)
+
+	tests := []struct {
+		name      string
+		raw       string
+		plaintext bool
+		cleared   bool
+	}{
+		{"START with sc=tls", testMessages[0], true, true},
+		{"SETUP with sc=tls", "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nsc=tls\r\nSubmit\r\n", true, true},
+		{"START with a bare sc", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\nSubmit\r\n", true, false},
+		{"SETUP with sc=tls without plaintext", "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nsc=tls\r\nSubmit\r\n", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientPlaintext = test.plaintext
+			msg, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			forward, cleared := plaintextForClient(msg)
+			if cleared != test.cleared {
+				t.Errorf("cleared = %v, want %v", cleared, test.cleared)
+			}
+			if !cleared && forward != msg {
+				t.Error("message copied without being changed")
+			}
+			if cleared && forward.Scheme() != SchemeNone {
+				t.Errorf("forwarded sc = %s, want %s", forward.Scheme(), SchemeNone)
+			}
+		})
+	}
+}
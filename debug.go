@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayEntry is a media relay direction in the registry
+type relayEntry struct {
+	name    string
+	started time.Time
+
+	bytes        atomic.Int64
+	lastActivity atomic.Int64
+}
+
+// RelayInfo describes a running relay direction
+type RelayInfo struct {
+	Name         string    `json:"name"`
+	Started      time.Time `json:"started"`
+	Bytes        int64     `json:"bytes"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// relayRegistry holds the relay directions currently running
+var relayRegistry = struct {
+	sync.Mutex
+	entries map[*relayEntry]struct{}
+}{entries: make(map[*relayEntry]struct{})}
+
+// runRelay runs one direction of a media relay, labeled with the session (from the context),
+// kind, direction and port, so that goroutine profiles can be attributed. It's listed in the
+// registry while it runs, and the bytes it moves are counted with the add function it's given,
+// both in the registry and in counter
+func runRelay(ctx context.Context, kind, direction, port string, counter *atomic.Int64, relay func(add func(n int))) {
+	session, _ := pprof.Label(ctx, "session")
+	entry := &relayEntry{
+		name:    fmt.Sprintf("session=%s kind=%s direction=%s port=%s", session, kind, direction, port),
+		started: time.Now(),
+	}
+	entry.lastActivity.Store(entry.started.UnixNano())
+
+	relayRegistry.Lock()
+	relayRegistry.entries[entry] = struct{}{}
+	relayRegistry.Unlock()
+
+	defer func() {
+		relayRegistry.Lock()
+		delete(relayRegistry.entries, entry)
+		relayRegistry.Unlock()
+	}()
+
+	add := func(n int) {
+		entry.bytes.Add(int64(n))
+		counter.Add(int64(n))
+		entry.lastActivity.Store(time.Now().UnixNano())
+	}
+
+	labels := pprof.Labels("kind", kind, "direction", direction, "port", port)
+	pprof.Do(ctx, labels, func(context.Context) { relay(add) })
+}
+
+// listRelays returns the relay directions currently running, oldest first
+func listRelays() []RelayInfo {
+	relayRegistry.Lock()
+	defer relayRegistry.Unlock()
+
+	relays := make([]RelayInfo, 0, len(relayRegistry.entries))
+	for entry := range relayRegistry.entries {
+		relays = append(relays, RelayInfo{
+			Name:         entry.name,
+			Started:      entry.started,
+			Bytes:        entry.bytes.Load(),
+			LastActivity: time.Unix(0, entry.lastActivity.Load()),
+		})
+	}
+
+	slices.SortFunc(relays, func(a, b RelayInfo) int { return a.Started.Compare(b.Started) })
+	return relays
+}
+
+// SessionInfo describes a running session
+type SessionInfo struct {
+	ID            int64         `json:"id"`
+	LogicalID     int64         `json:"logical_id"`
+	Listener      string        `json:"listener"`
+	ProtocolState ProtocolState `json:"protocol_state"`
+}
+
+// sessionRegistry holds the sessions currently running
+var sessionRegistry = struct {
+	sync.Mutex
+	sessions map[*Session]struct{}
+}{sessions: make(map[*Session]struct{})}
+
+// addSession lists a session in the registry while it runs. Its IDs and listener must be set
+// already, as they are read without synchronization
+func addSession(session *Session) {
+	sessionRegistry.Lock()
+	defer sessionRegistry.Unlock()
+
+	sessionRegistry.sessions[session] = struct{}{}
+}
+
+// removeSession removes a session from the registry once it ended
+func removeSession(session *Session) {
+	sessionRegistry.Lock()
+	defer sessionRegistry.Unlock()
+
+	delete(sessionRegistry.sessions, session)
+}
+
+// listSessions returns the sessions currently running, by ID
+func listSessions() []SessionInfo {
+	sessionRegistry.Lock()
+	defer sessionRegistry.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(sessionRegistry.sessions))
+	for session := range sessionRegistry.sessions {
+		sessions = append(sessions, SessionInfo{
+			ID:            session.ID,
+			LogicalID:     session.LogicalID,
+			Listener:      session.Listener,
+			ProtocolState: session.Protocol.State(),
+		})
+	}
+
+	slices.SortFunc(sessions, func(a, b SessionInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return sessions
+}
+
+// startDebugServer serves the pprof endpoints, the relay registry (/debug/relays), the running
+// sessions (/debug/sessions) and the protocol registry (/protocol) on the address set with the PONSE_DEBUG_ADDR env, if any. It's
+// meant to be bound to a local address, as there is no authentication
+func startDebugServer() {
+	address := os.Getenv("PONSE_DEBUG_ADDR")
+	if address == "" {
+		return
+	}
+
+	http.HandleFunc("/debug/relays", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(listRelays()); err != nil {
+			log.Printf("[DEBUG] %v\n", err)
+		}
+	})
+
+	http.HandleFunc("/debug/sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(listSessions()); err != nil {
+			log.Printf("[DEBUG] %v\n", err)
+		}
+	})
+
+	http.HandleFunc("/protocol", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(listProtocol()); err != nil {
+			log.Printf("[DEBUG] %v\n", err)
+		}
+	})
+
+	go func() {
+		log.Printf("[DEBUG] Serving debug endpoints on %s\n", address)
+		if err := http.ListenAndServe(address, nil); err != nil {
+			log.Printf("[DEBUG] %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DiffKind is how a part of a message differs between two messages
+type DiffKind string
+
+const (
+	// DiffChanged is a part in both messages, with another value
+	DiffChanged DiffKind = "changed"
+
+	// DiffAdded is a header only in the second message
+	DiffAdded DiffKind = "added"
+
+	// DiffRemoved is a header only in the first message
+	DiffRemoved DiffKind = "removed"
+
+	// DiffReordered is a change of the order of the headers in both messages
+	DiffReordered DiffKind = "reordered"
+)
+
+// Difference is a part of a message that differs between two messages
+type Difference struct {
+	Kind DiffKind
+
+	// Field is the part of the message that differs: "version", "type", "method", "seq", "code",
+	// "header", "order" for the order of the headers, or "body"
+	Field string
+
+	// Key is the header key, for the differences of a header
+	Key string
+
+	// Old and New are the values in the first and second message. A header is formatted as its
+	// line, like "sc=tls", and the order as the keys of the headers in both messages. Old is empty
+	// for an added header, and New for a removed one
+	Old string
+	New string
+}
+
+// MessageDiff are the differences between two messages, in the order of the message
+type MessageDiff []Difference
+
+// Diff returns the differences between two messages: the fields of the method line, the headers,
+// then the body. The headers are matched by key and occurrence, the n-th header with a key in a
+// being compared with the n-th one in b, so repeated headers are compared one by one. A change of
+// the order of the headers both messages have is a single DiffReordered difference. The line
+// endings aren't compared
+func Diff(a, b *Message) MessageDiff {
+	var diff MessageDiff
+	changed := func(field, old, new string) {
+		if old != new {
+			diff = append(diff, Difference{Kind: DiffChanged, Field: field, Old: old, New: new})
+		}
+	}
+
+	changed("version", a.Version, b.Version)
+	changed("type", a.Type.String(), b.Type.String())
+	changed("method", a.Method, b.Method)
+	changed("seq", strconv.Itoa(a.Sequence), strconv.Itoa(b.Sequence))
+	if a.IsResponse() || b.IsResponse() {
+		changed("code", strconv.Itoa(a.Code), strconv.Itoa(b.Code))
+	}
+
+	diff = append(diff, diffHeaders(a.Headers.Fields(), b.Headers.Fields())...)
+
+	// Bodies are compared as a whole, described by their size and first bytes
+	if !bytes.Equal(a.Body, b.Body) || (a.Body == nil) != (b.Body == nil) {
+		diff = append(diff, Difference{Kind: DiffChanged, Field: "body", Old: describeBody(a.Body), New: describeBody(b.Body)})
+	}
+
+	return diff
+}
+
+// describeBody describes a body in a difference, like "3 bytes 616263", or "none"
+func describeBody(body []byte) string {
+	if body == nil {
+		return "none"
+	}
+
+	return fmt.Sprintf("%d bytes %s", len(body), bodyPreview(body))
+}
+
+// headerOccurrence is the n-th header with a key in a message, starting at 0
+type headerOccurrence struct {
+	key string
+	n   int
+}
+
+// headerOccurrences returns the occurrence of each field, in order
+func headerOccurrences(fields []HeaderLine) []headerOccurrence {
+	counts := make(map[string]int)
+	occurrences := make([]headerOccurrence, len(fields))
+	for i, field := range fields {
+		occurrences[i] = headerOccurrence{key: field.Key, n: counts[field.Key]}
+		counts[field.Key]++
+	}
+
+	return occurrences
+}
+
+// diffHeaders returns the differences between the headers of two messages, as Diff describes
+func diffHeaders(a, b []HeaderLine) MessageDiff {
+	aOccurrences, bOccurrences := headerOccurrences(a), headerOccurrences(b)
+	inA := make(map[headerOccurrence]int, len(a))
+	for i, occurrence := range aOccurrences {
+		inA[occurrence] = i
+	}
+	inB := make(map[headerOccurrence]int, len(b))
+	for i, occurrence := range bOccurrences {
+		inB[occurrence] = i
+	}
+
+	var diff MessageDiff
+
+	// The keys of the headers in both messages, in the order of each message
+	var aOrder, bOrder []string
+	for i, occurrence := range aOccurrences {
+		j, ok := inB[occurrence]
+		if !ok {
+			diff = append(diff, Difference{Kind: DiffRemoved, Field: "header", Key: occurrence.key, Old: a[i].format()})
+			continue
+		}
+
+		aOrder = append(aOrder, occurrence.key)
+		if a[i].Value != b[j].Value || a[i].HasValue != b[j].HasValue {
+			diff = append(diff, Difference{Kind: DiffChanged, Field: "header", Key: occurrence.key, Old: a[i].format(), New: b[j].format()})
+		}
+	}
+
+	for j, occurrence := range bOccurrences {
+		if _, ok := inA[occurrence]; !ok {
+			diff = append(diff, Difference{Kind: DiffAdded, Field: "header", Key: occurrence.key, New: b[j].format()})
+			continue
+		}
+
+		bOrder = append(bOrder, occurrence.key)
+	}
+
+	if !slices.Equal(aOrder, bOrder) {
+		diff = append(diff, Difference{Kind: DiffReordered, Field: "order", Old: strings.Join(aOrder, " "), New: strings.Join(bOrder, " ")})
+	}
+
+	return diff
+}
+
+// Unified returns the differences in the style of a unified diff, with the names of both messages
+// first, and each line indented for logs like Message.Verbose. Removed values start with "-" and
+// added ones with "+", a header as its line and the other fields after their name:
+//
+//	--- received
+//	+++ forwarded
+//	- sc=tls
+//	+ sc
+func (d MessageDiff) Unified(from, to string) string {
+	lines := []string{"--- " + from, "+++ " + to}
+	for _, difference := range d {
+		label := ""
+		if difference.Field != "header" {
+			label = difference.Field + ": "
+		}
+
+		if difference.Kind != DiffAdded {
+			lines = append(lines, "- "+label+difference.Old)
+		}
+		if difference.Kind != DiffRemoved {
+			lines = append(lines, "+ "+label+difference.New)
+		}
+	}
+
+	for i, line := range lines {
+		lines[i] = "    " + line
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// EndReason is a stable code for why a session ended, for the scripts driving the proxy
+type EndReason string
+
+const (
+	// EndClientEOF is when the client closed the control connection
+	EndClientEOF EndReason = "client_eof"
+
+	// EndUpstreamEOF is when the server closed the control connection
+	EndUpstreamEOF EndReason = "upstream_eof"
+
+	// EndClientError is when reading from or writing to the client failed
+	EndClientError EndReason = "client_error"
+
+	// EndUpstreamError is when reading from or writing to the server failed
+	EndUpstreamError EndReason = "upstream_error"
+
+	// EndUpstreamUnreachable is when the server couldn't be dialed
+	EndUpstreamUnreachable EndReason = "upstream_unreachable"
+
+	// EndHandshakeFailed is when the TLS handshake with either side failed
+	EndHandshakeFailed EndReason = "handshake_failed"
+
+	// EndMessageTooLarge is when either side sent a message over one of the size limits
+	EndMessageTooLarge EndReason = "message_too_large"
+
+	// EndBudgetExhausted is when the server wasn't dialed because the attempt budget is used up
+	EndBudgetExhausted EndReason = "budget_exhausted"
+
+	// EndUnknown is for an error that doesn't match any other reason
+	EndUnknown EndReason = "unknown"
+)
+
+// sessionEndReason returns the end reason of a session from the error that ended it. The control
+// connections are served by a single goroutine, so a session only ever ends with one error: the
+// first failure it runs into. When both sides fail around the same time, the client is read
+// first on each pass, so the client side wins
+func sessionEndReason(err error) EndReason {
+	switch {
+	case errors.Is(err, ErrBudgetExceeded):
+		return EndBudgetExhausted
+	case errors.Is(err, ErrUpstreamDial):
+		return EndUpstreamUnreachable
+	case errors.Is(err, ErrHandshake):
+		return EndHandshakeFailed
+	case overLimit(err):
+		return EndMessageTooLarge
+	case errors.Is(err, ErrClientConnection) && errors.Is(err, io.EOF):
+		return EndClientEOF
+	case errors.Is(err, ErrClientConnection):
+		return EndClientError
+	case errors.Is(err, ErrUpstreamConnection) && errors.Is(err, io.EOF):
+		return EndUpstreamEOF
+	case errors.Is(err, ErrUpstreamConnection):
+		return EndUpstreamError
+	default:
+		return EndUnknown
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import "errors"
+
+// Errors returned by the proxy. They are always wrapped together with the underlying error,
+// so errors.Is can be used to find out where a session failed
+var (
+	// ErrUpstreamDial is returned when the connection to the destination server can't be made
+	ErrUpstreamDial = errors.New("failed to dial upstream")
+
+	// ErrUpstreamConnection is returned when reading from or writing to the destination server fails
+	ErrUpstreamConnection = errors.New("upstream connection error")
+
+	// ErrClientConnection is returned when reading from or writing to the client fails
+	ErrClientConnection = errors.New("client connection error")
+
+	// ErrClientParse is returned when a message sent by the client can't be parsed
+	ErrClientParse = errors.New("failed to parse client message")
+
+	// ErrServerParse is returned when a message sent by the server can't be parsed
+	ErrServerParse = errors.New("failed to parse server message")
+
+	// ErrHandshake is returned when the TLS handshake with either side fails
+	ErrHandshake = errors.New("TLS handshake failed")
+
+	// ErrMediaBind is returned when a media listener can't be started
+	ErrMediaBind = errors.New("failed to bind media listener")
+
+	// ErrOutOfSpec is returned when strict parsing rejects a message that lenient parsing accepts
+	ErrOutOfSpec = errors.New("message out of spec")
+
+	// ErrInvalidHeader is returned when a header set by the proxy can't be written as a single line
+	ErrInvalidHeader = errors.New("invalid header")
+
+	// ErrTooManyHeaders is returned when a message has more header lines than the proxy accepts
+	ErrTooManyHeaders = errors.New("too many headers")
+
+	// ErrUnknownTransport is returned when the server announces media over a transport the proxy can't relay
+	ErrUnknownTransport = errors.New("unknown media transport")
+
+	// ErrMessageTooLarge is returned when a message exceeds the size the proxy can handle
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrTruncatedMessage is returned when a stream ends in the middle of a message
+	ErrTruncatedMessage = errors.New("truncated message")
+
+	// ErrBudgetExceeded is returned when the upstream isn't dialed because the attempt limits are reached
+	ErrBudgetExceeded = errors.New("upstream attempt budget exceeded")
+
+	// ErrRelayStalled is returned when a media connection keeps returning no data without an error
+	ErrRelayStalled = errors.New("media relay stalled")
+
+	// ErrMediaIdle is returned when a media connection relays no data for longer than the idle timeout
+	ErrMediaIdle = errors.New("media connection idle")
+
+	// ErrMediaLifetime is returned when a media connection reaches its maximum lifetime
+	ErrMediaLifetime = errors.New("media connection lifetime exceeded")
+)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Escalation triggers, as set in PONSE_ESCALATE_ON
+const (
+	// TriggerParseError is when a message of either side can't be parsed
+	TriggerParseError = "parse_error"
+
+	// TriggerHandshakeFailed is when the TLS handshake with either side fails
+	TriggerHandshakeFailed = "handshake_failed"
+)
+
+// escalationHistory is the number of messages kept from before an escalation
+const escalationHistory = 32
+
+// defaultEscalationDuration is how long an escalation captures the messages if
+// PONSE_ESCALATION_DURATION isn't set
+const defaultEscalationDuration = 30 * time.Second
+
+// escalationCooldown is how long after an escalation another one can start on the same session,
+// so that a peer sending garbage in a loop doesn't write a report per message
+const escalationCooldown = 5 * time.Minute
+
+// escalationCount counts the escalations of every session since the proxy started
+var escalationCount atomic.Int64
+
+// capturedMessage is a control message captured for an escalation report
+type capturedMessage struct {
+	at     time.Time
+	source string
+	raw    []byte
+}
+
+// escalation captures the control messages of a session when something goes wrong. The last
+// messages are always kept, and when a trigger fires they are written to a report together with
+// the messages that follow, for a limited time. Running with full logging all the time is too
+// expensive, and by the time a problem is noticed the interesting messages are gone. The methods
+// do nothing on a nil escalation, which is what sessions without triggers have
+type escalation struct {
+	session *Session
+
+	triggers map[string]bool
+	duration time.Duration
+
+	// history holds the last messages, before any escalation
+	history []capturedMessage
+
+	// trigger is what started the current escalation, and until when it captures. It's empty
+	// if no escalation is running
+	trigger   string
+	startedAt time.Time
+	until     time.Time
+	captured  []capturedMessage
+
+	// lastEscalation is when the last escalation started, for the cooldown
+	lastEscalation time.Time
+}
+
+// newEscalation creates the escalation of a session, with the triggers set with the
+// PONSE_ESCALATE_ON env as a comma separated list. It returns nil if no trigger is set
+func newEscalation(session *Session) *escalation {
+	triggers := make(map[string]bool)
+	for _, trigger := range strings.Split(os.Getenv("PONSE_ESCALATE_ON"), ",") {
+		switch trigger = strings.TrimSpace(trigger); trigger {
+		case "":
+		case TriggerParseError, TriggerHandshakeFailed:
+			triggers[trigger] = true
+		default:
+			log.Printf("Unknown escalation trigger %q in PONSE_ESCALATE_ON\n", trigger)
+		}
+	}
+	if len(triggers) == 0 {
+		return nil
+	}
+
+	duration := envDuration("PONSE_ESCALATION_DURATION")
+	if duration <= 0 {
+		duration = defaultEscalationDuration
+	}
+
+	return &escalation{session: session, triggers: triggers, duration: duration}
+}
+
+// record captures a control message sent by the given side. It's only called from the goroutine
+// serving the control connections, so it needs no locking
+func (e *escalation) record(source string, raw []byte) {
+	if e == nil {
+		return
+	}
+
+	// The bytes belong to the MessageReader, which reuses them for the next message
+	message := capturedMessage{at: time.Now(), source: source, raw: bytes.Clone(raw)}
+	if e.trigger != "" {
+		if message.at.Before(e.until) {
+			e.captured = append(e.captured, message)
+			return
+		}
+		e.finish()
+	}
+
+	e.history = append(e.history, message)
+	if len(e.history) > escalationHistory {
+		e.history = e.history[1:]
+	}
+}
+
+// fire starts an escalation if the trigger is enabled, no escalation is running, and the last
+// one is older than the cooldown
+func (e *escalation) fire(trigger string, cause error) {
+	if e == nil || !e.triggers[trigger] || e.trigger != "" {
+		return
+	}
+
+	now := time.Now()
+	if !e.lastEscalation.IsZero() && now.Sub(e.lastEscalation) < escalationCooldown {
+		log.Printf("[ESCALATION] %s on session %d not escalated, the last escalation was %v ago\n", trigger, e.session.ID, now.Sub(e.lastEscalation).Round(time.Second))
+		return
+	}
+
+	e.trigger = fmt.Sprintf("%s: %v", trigger, cause)
+	e.startedAt = now
+	e.until = now.Add(e.duration)
+	e.lastEscalation = now
+	escalationCount.Add(1)
+
+	log.Printf("[ESCALATION] %s on session %d, capturing the messages for %v (%d escalations since the proxy started)\n", trigger, e.session.ID, e.duration, escalationCount.Load())
+}
+
+// finish ends the running escalation, if any, and writes its report
+func (e *escalation) finish() {
+	if e == nil || e.trigger == "" {
+		return
+	}
+
+	path, err := e.writeReport()
+	if err != nil {
+		log.Printf("[ESCALATION] Failed to write the report of session %d: %v\n", e.session.ID, err)
+	} else {
+		log.Printf("[ESCALATION] Report of session %d written to %s\n", e.session.ID, path)
+	}
+
+	e.trigger = ""
+	e.history = nil
+	e.captured = nil
+}
+
+// writeReport writes the messages from before and during the escalation to a file in the
+// PONSE_ESCALATION_DIR directory, the working directory by default. It returns the path
+func (e *escalation) writeReport() (string, error) {
+	builder := &strings.Builder{}
+	builder.WriteString(fmt.Sprintf("Escalation of session %d (connection %d)\n", e.session.LogicalID, e.session.ID))
+	builder.WriteString(fmt.Sprintf("Trigger: %s\n", e.trigger))
+	builder.WriteString(fmt.Sprintf("Started: %s\n", e.startedAt.Format(time.RFC3339Nano)))
+	builder.WriteString(fmt.Sprintf("Session: %s\n", e.session.Summary()))
+
+	for _, section := range []struct {
+		title    string
+		messages []capturedMessage
+	}{{"Messages before the trigger", e.history}, {"Messages during the escalation", e.captured}} {
+		builder.WriteString(fmt.Sprintf("\n%s (%d):\n", section.title, len(section.messages)))
+		for _, message := range section.messages {
+			builder.WriteString(fmt.Sprintf("%s %s %q\n", message.at.Format(time.RFC3339Nano), message.source, message.raw))
+		}
+	}
+
+	name := fmt.Sprintf("ponse-escalation-%d-%s.txt", e.session.ID, e.startedAt.Format("20060102-150405"))
+	path := filepath.Join(os.Getenv("PONSE_ESCALATION_DIR"), name)
+	return path, os.WriteFile(path, []byte(builder.String()), 0644)
+}
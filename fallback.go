@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+)
+
+// tlsFallbackEnabled returns whether a connection falls back to plaintext when the peer didn't
+// upgrade to TLS, set with the PONSE_TLS_FALLBACK env. Failed handshakes end the session otherwise
+func tlsFallbackEnabled() bool {
+	return len(os.Getenv("PONSE_TLS_FALLBACK")) > 0
+}
+
+// handshakeRecorder records the bytes read from a connection during a TLS handshake, so that
+// they can be replayed if the peer turns out to speak plaintext
+type handshakeRecorder struct {
+	net.Conn
+	recorded []byte
+	done     bool
+}
+
+func (c *handshakeRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done {
+		c.recorded = append(c.recorded, b[:n]...)
+	}
+	return n, err
+}
+
+// replayConn returns the pending bytes before reading from the connection
+type replayConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// plaintextFallback checks whether a failed handshake is a peer that didn't upgrade: the TLS
+// record layer rejected its first bytes, and they are a plaintext iRTSP message. If so, it
+// returns the plain connection, replaying the bytes read during the handshake
+func plaintextFallback(err error, recorder *handshakeRecorder) (net.Conn, bool) {
+	var recordErr tls.RecordHeaderError
+	if !tlsFallbackEnabled() || !errors.As(err, &recordErr) {
+		return nil, false
+	}
+
+	if msg, err := NewMessage(recorder.recorded); err != nil || msg.Method == "" {
+		return nil, false
+	}
+
+	return &replayConn{Conn: recorder.Conn, pending: recorder.recorded}, true
+}
+
+// withPending returns the connection replaying the pending bytes first, if there are any
+func withPending(conn net.Conn, pending []byte) net.Conn {
+	if len(pending) == 0 {
+		return conn
+	}
+
+	return &replayConn{Conn: conn, pending: pending}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFrameSize is the largest frame the decoder accepts. A larger length means the framing
+// doesn't match the stream
+const maxFrameSize = 64 * 1024
+
+// FrameFormat describes where the length of a frame is. The KNOCK framing hasn't been pinned
+// down from the dumps yet, so the length field is configurable
+type FrameFormat struct {
+	// Offset is the position of the length field from the start of the frame
+	Offset int
+
+	// Width is the size of the length field in bytes: 1, 2 or 4
+	Width int
+
+	// LittleEndian is whether the length field is little endian. It's big endian by default
+	LittleEndian bool
+}
+
+// knockFrameFormat returns the KNOCK frame format set with the PONSE_KNOCK_FRAMING env as
+// "<offset>:<width>[:le]", like "0:2". The length is the number of bytes after the length field.
+// It returns nil if the env isn't set, and the KNOCK stream isn't decoded
+func knockFrameFormat() *FrameFormat {
+	value := os.Getenv("PONSE_KNOCK_FRAMING")
+	if value == "" {
+		return nil
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		log.Printf("Invalid PONSE_KNOCK_FRAMING %q\n", value)
+		return nil
+	}
+
+	offset, err := strconv.Atoi(parts[0])
+	if err != nil || offset < 0 {
+		log.Printf("Invalid PONSE_KNOCK_FRAMING offset %q\n", parts[0])
+		return nil
+	}
+
+	width, err := strconv.Atoi(parts[1])
+	if err != nil || (width != 1 && width != 2 && width != 4) {
+		log.Printf("Invalid PONSE_KNOCK_FRAMING width %q\n", parts[1])
+		return nil
+	}
+
+	return &FrameFormat{Offset: offset, Width: width, LittleEndian: len(parts) == 3 && parts[2] == "le"}
+}
+
+// length reads the length field at the start of a frame
+func (f *FrameFormat) length(frame []byte) int {
+	field := frame[f.Offset : f.Offset+f.Width]
+
+	var order binary.ByteOrder = binary.BigEndian
+	if f.LittleEndian {
+		order = binary.LittleEndian
+	}
+
+	switch f.Width {
+	case 1:
+		return int(field[0])
+	case 2:
+		return int(order.Uint16(field))
+	default:
+		return int(order.Uint32(field))
+	}
+}
+
+// frameDecoder splits one direction of a relayed stream into frames and logs them. It only
+// observes the stream: the bytes are relayed as they come whether the decoding works or not
+type frameDecoder struct {
+	format    *FrameFormat
+	kind      string
+	direction string
+
+	buffer  []byte
+	frames  int
+	started time.Time
+	last    time.Time
+	failed  bool
+}
+
+// newFrameDecoder creates a decoder for a direction of a media relay. It returns nil if the
+// stream of the kind isn't decoded
+func newFrameDecoder(kind, direction string) *frameDecoder {
+	if kind != "KNOCK" {
+		return nil
+	}
+
+	format := knockFrameFormat()
+	if format == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &frameDecoder{format: format, kind: kind, direction: direction, started: now, last: now}
+}
+
+// feed adds relayed bytes to the decoder, and logs every frame they complete
+func (d *frameDecoder) feed(data []byte) {
+	if d.failed {
+		return
+	}
+	d.buffer = append(d.buffer, data...)
+
+	header := d.format.Offset + d.format.Width
+	for len(d.buffer) >= header {
+		size := header + d.format.length(d.buffer)
+		if size > maxFrameSize {
+			d.failed = true
+			d.buffer = nil
+			log.Printf("[%s] Unknown framing: %s frame %d would be %d bytes, relaying raw bytes only\n", d.kind, d.direction, d.frames+1, size)
+			return
+		}
+		if len(d.buffer) < size {
+			return
+		}
+
+		now := time.Now()
+		d.frames++
+		log.Printf("[%s] %s frame %d: %d bytes, +%v: %x\n", d.kind, d.direction, d.frames, size, now.Sub(d.last), d.buffer[:min(size, 32)])
+		d.last = now
+		d.buffer = d.buffer[size:]
+	}
+}
+
+// Summary returns the number of frames decoded and the frame rate
+func (d *frameDecoder) Summary() string {
+	if d.failed {
+		return fmt.Sprintf("%d frames before the framing failed", d.frames)
+	}
+
+	elapsed := time.Since(d.started).Seconds()
+	if elapsed == 0 {
+		return fmt.Sprintf("%d frames", d.frames)
+	}
+
+	return fmt.Sprintf("%d frames, %.1f frames/s, %d bytes left over", d.frames, float64(d.frames)/elapsed, len(d.buffer))
+}
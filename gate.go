@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// mediaGate holds the media connections of a server message until that message has been
+// written to the client. The client mustn't connect to the media ports before it receives the
+// response announcing them, so a connection arriving earlier means the proxy reordered events
+type mediaGate struct {
+	// method is the method of the message announcing the media ports, for logging
+	method string
+
+	ready chan struct{}
+	once  sync.Once
+	ok    bool
+}
+
+// newMediaGate creates a closed gate for the media announced by a message with the given method
+func newMediaGate(method string) *mediaGate {
+	return &mediaGate{method: method, ready: make(chan struct{})}
+}
+
+// open releases the held connections. If ok is false the message never reached the client,
+// and the held connections are dropped instead
+func (g *mediaGate) open(ok bool) {
+	g.once.Do(func() {
+		g.ok = ok
+		close(g.ready)
+	})
+}
+
+// wait blocks until the gate is opened, and returns whether the connection can be relayed.
+// A connection arriving before the gate opens is logged as an ordering anomaly. conn can be
+// nil for the UDP sockets, which are started right away and don't arrive early
+func (g *mediaGate) wait(kind string, conn net.Conn) bool {
+	select {
+	case <-g.ready:
+		return g.ok
+	default:
+	}
+
+	if conn != nil {
+		log.Printf("[ANOMALY] %s connection from %s arrived before the %s response reached the client, holding it\n", kind, conn.RemoteAddr(), g.method)
+	}
+
+	<-g.ready
+	if conn != nil {
+		if g.ok {
+			log.Printf("[%s] Released connection from %s\n", kind, conn.RemoteAddr())
+		} else {
+			log.Printf("[%s] Dropping connection from %s, the %s response never reached the client\n", kind, conn.RemoteAddr(), g.method)
+		}
+	}
+
+	return g.ok
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Header keys known to be sent by the server
+const (
+	// HeaderVideo is the transport of the video stream, announced on SETUP
+	HeaderVideo = "v"
+
+	// HeaderAudio is the transport of the audio stream, announced on SETUP. It's usually the
+	// same as the video one
+	HeaderAudio = "a"
+
+	// HeaderControl is the transport of the control stream, announced on SETUP
+	HeaderControl = "c"
+
+	// HeaderKnockPort is the transport of the KNOCK connection, announced on KNOCK with a
+	// trailing ";"
+	HeaderKnockPort = "p"
+
+	// HeaderScheme tells the client whether to upgrade the connection to TLS, on START
+	HeaderScheme = "sc"
+
+	// HeaderTime is sent on START, like "t=1429051". What it counts hasn't been confirmed yet,
+	// see Message.Tick and SessionTimer
+	HeaderTime = "t"
+)
+
+// Headers are the header fields of a message. The fields are kept in the order they were
+// received, so that a message is forwarded as it came, and indexed by key for the lookups.
+// The zero value is an empty set of headers ready to use
+type Headers struct {
+	fields []HeaderLine
+
+	// index maps each key to the position of its first field. It's nil while there are no more
+	// than indexedFields fields, which is the case of most messages, and the fields are scanned
+	// instead, as that's faster than building a map
+	index map[string]int
+
+	// modified is set once a field is changed, added or removed after parsing
+	modified bool
+}
+
+// indexedFields is the number of fields above which Headers are indexed
+const indexedFields = 8
+
+// HeaderLine is a header field, with the line it was received as
+type HeaderLine struct {
+	// Key is the header key the line was parsed as
+	Key string
+
+	// Value is the header value the line was parsed as
+	Value string
+
+	// HasValue is whether the line has an equal sign. A bare header like "sc" has none, while
+	// "sc=" has an empty value
+	HasValue bool
+
+	// Raw is the line as it was received, without the line ending. It's empty if the field
+	// was set by the proxy, and the line is then formatted from the key and value
+	Raw string
+
+	// Ambiguous is set when the line has more than one equal sign, so that the key could
+	// contain one too. The line was split following headerSplit
+	Ambiguous bool
+}
+
+// Get returns the value of the first field with the given key, or an empty string if there is
+// none. Use Lookup to tell a missing header from a flag header, which has no value
+func (h *Headers) Get(key string) string {
+	value, _ := h.Lookup(key)
+	return value
+}
+
+// Lookup returns the value of the first field with the given key, and whether there is one
+func (h *Headers) Lookup(key string) (string, bool) {
+	i, ok := h.first(key)
+	if !ok {
+		return "", false
+	}
+
+	return h.fields[i].Value, true
+}
+
+// Values returns the values of every field with the given key, in order
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, field := range h.fields {
+		if field.Key == key {
+			values = append(values, field.Value)
+		}
+	}
+
+	return values
+}
+
+// Add appends a field, keeping the ones already there with the same key
+func (h *Headers) Add(key, value string) error {
+	if err := validateHeader(key, value); err != nil {
+		return err
+	}
+
+	h.add(HeaderLine{Key: key, Value: value, HasValue: true})
+	h.modified = true
+	return nil
+}
+
+// Set sets the value of a header, written as "key=value" even if the value is empty. The first
+// field with the key is changed in place, keeping its position, and the other ones are removed.
+// If there is none, the field is added at the end
+func (h *Headers) Set(key, value string) error {
+	if err := validateHeader(key, value); err != nil {
+		return err
+	}
+
+	h.set(HeaderLine{Key: key, Value: value, HasValue: true})
+	return nil
+}
+
+// SetBare sets a header without a value, written as the key alone, like the "sc" flag. It
+// replaces the fields with the key like Set
+func (h *Headers) SetBare(key string) error {
+	if err := validateHeader(key, ""); err != nil {
+		return err
+	}
+
+	h.set(HeaderLine{Key: key})
+	return nil
+}
+
+// set replaces the fields with the key of the given field
+func (h *Headers) set(field HeaderLine) {
+	key := field.Key
+	i, ok := h.first(key)
+	if !ok {
+		h.add(field)
+		h.modified = true
+		return
+	}
+
+	if h.fields[i].Value != field.Value || h.fields[i].HasValue != field.HasValue {
+		h.fields[i] = field
+		h.modified = true
+	}
+
+	for j := len(h.fields) - 1; j > i; j-- {
+		if h.fields[j].Key == key {
+			h.fields = append(h.fields[:j], h.fields[j+1:]...)
+			h.modified = true
+		}
+	}
+	h.reindex()
+}
+
+// Replace changes the value of the fields with the given key and value in place, keeping the
+// other fields with the key
+func (h *Headers) Replace(key, value, replacement string) error {
+	if err := validateHeader(key, replacement); err != nil {
+		return err
+	}
+
+	for i, field := range h.fields {
+		if field.Key == key && field.Value == value && value != replacement {
+			h.fields[i] = HeaderLine{Key: key, Value: replacement, HasValue: true}
+			h.modified = true
+		}
+	}
+
+	return nil
+}
+
+// validateHeader returns an error if a header can't be written as a single line. A line ending
+// in the key or value would split the message on the wire, and there is no way to escape it
+func validateHeader(key, value string) error {
+	if strings.ContainsAny(key, "\r\n") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%w: line ending in %q=%q", ErrInvalidHeader, key, value)
+	}
+
+	return nil
+}
+
+// Del removes every field with the given key
+func (h *Headers) Del(key string) {
+	if _, ok := h.first(key); !ok {
+		return
+	}
+
+	fields := h.fields[:0]
+	for _, field := range h.fields {
+		if field.Key != key {
+			fields = append(fields, field)
+		}
+	}
+	h.fields = fields
+	h.modified = true
+	h.reindex()
+}
+
+// Clone returns a copy of the headers
+func (h *Headers) Clone() Headers {
+	return Headers{fields: slices.Clone(h.fields), index: maps.Clone(h.index), modified: h.modified}
+}
+
+// Len returns the number of fields
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// Fields returns the fields in order. The slice mustn't be modified
+func (h *Headers) Fields() []HeaderLine {
+	return h.fields
+}
+
+// first returns the position of the first field with the given key, and whether there is one
+func (h *Headers) first(key string) (int, bool) {
+	if h.index != nil {
+		i, ok := h.index[key]
+		return i, ok
+	}
+
+	for i, field := range h.fields {
+		if field.Key == key {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// add appends a field
+func (h *Headers) add(field HeaderLine) {
+	h.fields = append(h.fields, field)
+	if h.index == nil {
+		if len(h.fields) > indexedFields {
+			h.reindex()
+		}
+		return
+	}
+
+	if _, ok := h.index[field.Key]; !ok {
+		h.index[field.Key] = len(h.fields) - 1
+	}
+}
+
+// reindex rebuilds the index after fields were added or removed, or drops it if there are few
+// enough fields to scan them
+func (h *Headers) reindex() {
+	if len(h.fields) <= indexedFields {
+		h.index = nil
+		return
+	}
+
+	h.index = make(map[string]int, len(h.fields))
+	for i := len(h.fields) - 1; i >= 0; i-- {
+		h.index[h.fields[i].Key] = i
+	}
+}
+
+// String formats the fields in order, like "[sc=tcp t=1]", for the message logs
+func (h Headers) String() string {
+	lines := make([]string, len(h.fields))
+	for i, field := range h.fields {
+		lines[i] = field.format()
+	}
+
+	return "[" + strings.Join(lines, " ") + "]"
+}
+
+// format formats the field as a header line, with an equal sign only if it has a value
+func (f HeaderLine) format() string {
+	return string(f.appendTo(nil))
+}
+
+// appendTo appends the field formatted as a header line to b. Line endings, which the mutation
+// methods reject but a field built by hand can hold, are written as spaces so that the message
+// keeps its framing
+func (f HeaderLine) appendTo(b []byte) []byte {
+	b = appendHeaderText(b, f.Key)
+	if !f.HasValue {
+		return b
+	}
+
+	return appendHeaderText(append(b, '='), f.Value)
+}
+
+// appendHeaderText appends a key or value to b, with its line endings replaced by spaces
+func appendHeaderText(b []byte, text string) []byte {
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c == '\r' || c == '\n' {
+			b = append(b, ' ')
+		} else {
+			b = append(b, c)
+		}
+	}
+
+	return b
+}
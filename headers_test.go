@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// captureCorpus returns the test messages and the raw messages of the conformance vectors
+func captureCorpus(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	corpus := make(map[string][]byte)
+	for i, msg := range testMessages {
+		corpus["message"+strconv.Itoa(i)] = []byte(msg)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(defaultVectorsDir, "*.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus[strings.TrimSuffix(filepath.Base(path), ".raw")] = raw
+	}
+
+	return corpus
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	for name, raw := range captureCorpus(t) {
+		t.Run(name, func(t *testing.T) {
+			msg, err := NewMessage(raw)
+			if err != nil {
+				t.Skipf("not a valid message: %v", err)
+			}
+
+			if forwarded := msg.ToBytes(); !bytes.Equal(forwarded, raw) {
+				t.Errorf("ToBytes() = %q, want %q", forwarded, raw)
+			}
+
+			// The Seq line is always written, so a message without one is only reproduced by
+			// ToBytes
+			if !bytes.Contains(raw, []byte("\nSeq=")) {
+				return
+			}
+			if serialized := msg.Serialize(true); !bytes.Equal(serialized, raw) {
+				t.Errorf("Serialize(true) = %q, want %q", serialized, raw)
+			}
+		})
+	}
+}
+
+// manyHeaders returns a message with more fields than indexedFields, so that lookups go through
+// the index
+func manyHeaders(t *testing.T) *Message {
+	t.Helper()
+
+	raw := "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\n"
+	for i := 0; i < 2*indexedFields; i++ {
+		raw += "h" + strconv.Itoa(i) + "=" + strconv.Itoa(i) + "\r\n"
+	}
+	msg, err := NewMessage([]byte(raw + "Submit\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestHeadersGetSetDel(t *testing.T) {
+	for _, fields := range []int{3, 2 * indexedFields} {
+		t.Run(strconv.Itoa(fields)+" fields", func(t *testing.T) {
+			msg := manyHeaders(t)
+			for msg.Headers.Len() > fields {
+				last := msg.Headers.Fields()[msg.Headers.Len()-1]
+				msg.Headers.Del(last.Key)
+			}
+
+			if got := msg.Headers.Get("h1"); got != "1" {
+				t.Errorf("Get(h1) = %q, want 1", got)
+			}
+			if _, ok := msg.Headers.Lookup("missing"); ok {
+				t.Error("Lookup(missing) found a header")
+			}
+
+			// Set changes the field in place
+			if err := msg.Headers.Set("h1", "changed"); err != nil {
+				t.Fatal(err)
+			}
+			if field := msg.Headers.Fields()[1]; field.Key != "h1" || field.Value != "changed" {
+				t.Errorf("field 1 after Set(h1) = %q, want h1=changed", field.format())
+			}
+
+			// Del shifts the fields after it, which lookups have to follow
+			msg.Headers.Del("h0")
+			if _, ok := msg.Headers.Lookup("h0"); ok {
+				t.Error("Lookup(h0) found a deleted header")
+			}
+			if got := msg.Headers.Get("h2"); got != "2" {
+				t.Errorf("Get(h2) after Del(h0) = %q, want 2", got)
+			}
+
+			// Set adds a missing header at the end
+			if err := msg.Headers.Set("new", "v"); err != nil {
+				t.Fatal(err)
+			}
+			if field := msg.Headers.Fields()[msg.Headers.Len()-1]; field.format() != "new=v" {
+				t.Errorf("last field after Set(new) = %q, want new=v", field.format())
+			}
+			if got := msg.Headers.Get("new"); got != "v" {
+				t.Errorf("Get(new) = %q, want v", got)
+			}
+
+			want := []string{"h1=changed"}
+			for i := 2; i < fields; i++ {
+				want = append(want, "h"+strconv.Itoa(i)+"="+strconv.Itoa(i))
+			}
+			want = append(want, "new=v")
+			if got := msg.Headers.String(); got != "["+strings.Join(want, " ")+"]" {
+				t.Errorf("headers = %s, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHeadersDuplicates(t *testing.T) {
+	raw := "iRTSP/1.21\r\nSeq=4\r\nRSP/KNOCK/200\r\np=iDataChunk/unicast/tcp/40607;\r\nt=1\r\np=iDataChunk/unicast/tcp/40608;\r\nSubmit\r\n"
+	msg, err := NewMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Headers.Get("p"); got != "iDataChunk/unicast/tcp/40607;" {
+		t.Errorf("Get(p) = %q, want the first value", got)
+	}
+	if got := msg.Headers.Values("p"); strings.Join(got, " ") != "iDataChunk/unicast/tcp/40607; iDataChunk/unicast/tcp/40608;" {
+		t.Errorf("Values(p) = %q, want both values in order", got)
+	}
+	if serialized := msg.Serialize(false); string(serialized) != raw {
+		t.Errorf("Serialize(false) = %q, want %q", serialized, raw)
+	}
+
+	// Add keeps the fields already there, and each one is written on its own line
+	if err := msg.Headers.Add("p", "iDataChunk/unicast/tcp/40609;"); err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Headers.Values("p"); len(got) != 3 || got[2] != "iDataChunk/unicast/tcp/40609;" {
+		t.Errorf("Values(p) after Add = %q, want the added value last", got)
+	}
+	want := strings.Replace(raw, "Submit\r\n", "p=iDataChunk/unicast/tcp/40609;\r\nSubmit\r\n", 1)
+	if forwarded := msg.ToBytes(); string(forwarded) != want {
+		t.Errorf("ToBytes() after Add = %q, want %q", forwarded, want)
+	}
+}
+
+func TestHeadersBareAndEmpty(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		hasValue bool
+	}{
+		{"bare", "sc", false},
+		{"empty value", "sc=", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\n" + test.line + "\r\nt=1\r\nSubmit\r\n"
+			msg, err := NewMessage([]byte(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, ok := msg.Headers.Lookup("sc")
+			if !ok || value != "" {
+				t.Errorf("Lookup(sc) = %q, %v, want an empty value", value, ok)
+			}
+			if field := msg.Headers.Fields()[0]; field.HasValue != test.hasValue {
+				t.Errorf("HasValue = %v, want %v", field.HasValue, test.hasValue)
+			}
+			if serialized := msg.Serialize(false); string(serialized) != raw {
+				t.Errorf("Serialize(false) = %q, want %q", serialized, raw)
+			}
+		})
+	}
+}
+
+func TestHeadersSetBare(t *testing.T) {
+	msg, err := NewMessage([]byte(testMessages[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := msg.Headers.SetBare("sc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(msg.ToBytes()); got != "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\nSubmit\r\n" {
+		t.Errorf("ToBytes() after SetBare(sc) = %q, want a bare sc line", got)
+	}
+
+	if err := msg.Headers.Set("sc", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(msg.ToBytes()); got != "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc=\r\nt=1429051\r\nSubmit\r\n" {
+		t.Errorf(`ToBytes() after Set(sc, "") = %q, want "sc="`, got)
+	}
+}
+
+func TestHeadersTrimSpaces(t *testing.T) {
+	raw := "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\n t =1429051\r\nsc\t= tls \r\nSubmit\r\n"
+
+	msg, err := NewMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Headers.Get("t"); got != "1429051" {
+		t.Errorf("Get(t) = %q, want 1429051", got)
+	}
+	if msg.Scheme() != SchemeTLS {
+		t.Errorf("Scheme() = %s, want tls", msg.Scheme())
+	}
+
+	// The spacing is kept on the wire while the message isn't changed
+	if got := string(msg.ToBytes()); got != raw {
+		t.Errorf("ToBytes() = %q, want %q", got, raw)
+	}
+	if got := string(msg.Serialize(false)); got != raw {
+		t.Errorf("Serialize(false) = %q, want %q", got, raw)
+	}
+
+	// Changing another header keeps the spacing of the fields left as received
+	changed := msg.Clone()
+	if err := changed.Headers.Set("x", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(changed.ToBytes()), strings.Replace(raw, "Submit", "x=1\r\nSubmit", 1); got != want {
+		t.Errorf("ToBytes() after Set(x) = %q, want %q", got, want)
+	}
+
+	kept, err := ParseMessage([]byte(raw), ParseOptions{KeepSpaces: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kept.Headers.Lookup("t"); ok {
+		t.Error("Lookup(t) found the header with KeepSpaces")
+	}
+	if got := kept.Headers.Get(" t "); got != "1429051" {
+		t.Errorf(`Get(" t ") with KeepSpaces = %q, want 1429051`, got)
+	}
+
+	if _, err := ParseMessage([]byte(raw), ParseOptions{Strict: true}); !errors.Is(err, ErrOutOfSpec) {
+		t.Errorf("strict ParseMessage() error = %v, want ErrOutOfSpec", err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for the mock servers
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ponse test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// useTestUpstream points the proxy at a loopback listener, with the state files in a temporary
+// directory and no connection budget. The globals are restored when the test ends
+func useTestUpstream(t *testing.T, listener net.Listener, plaintext bool) {
+	t.Helper()
+
+	oldNetwork, oldControl, oldAddress := serverNetwork, serverControlAddress, serverAddress
+	oldPlaintext, oldConfig := clientPlaintext, config
+	t.Cleanup(func() {
+		serverNetwork, serverControlAddress, serverAddress = oldNetwork, oldControl, oldAddress
+		clientPlaintext, config = oldPlaintext, oldConfig
+	})
+
+	serverNetwork = "tcp"
+	serverControlAddress = listener.Addr().String()
+	serverAddress = "127.0.0.1"
+	clientPlaintext = plaintext
+	config = &tls.Config{MinVersion: tls.VersionTLS10, InsecureSkipVerify: true}
+
+	dir := t.TempDir()
+	t.Setenv("PONSE_BUDGET_FILE", filepath.Join(dir, "budget.json"))
+	t.Setenv("PONSE_HISTORY_FILE", filepath.Join(dir, "history.json"))
+	t.Setenv("PONSE_SESSIONS_FILE", filepath.Join(dir, "sessions.json"))
+	t.Setenv("PONSE_MAX_ATTEMPTS_HOUR", "")
+	t.Setenv("PONSE_MAX_ATTEMPTS_DAY", "")
+}
+
+// freePort returns a TCP port nothing listens on, for the media announced by the mock servers
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// readTestMessage reads the next message, failing if it isn't the method of the given type
+func readTestMessage(reader *MessageReader, messageType MessageType, method string) (*Message, error) {
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != messageType || msg.Method != method {
+		return nil, fmt.Errorf("got %s, want a %s %s", msg, messageType, method)
+	}
+
+	return msg, nil
+}
+
+// TestProxyClientPlaintext runs a session through the proxy in client plaintext mode, between a
+// plaintext client and a server upgrading to TLS on START.
+//
+// The media relays can't be checked end to end here: the proxy listens for the media on the
+// announced port on every address, which is the port the server has to listen on too. They are
+// checked against a loopback server in TestMediaRelay instead
+func TestProxyClientPlaintext(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	useTestUpstream(t, listener, true)
+
+	certificate := testCertificate(t)
+	setupResponse := "iRTSP/1.21\r\nSeq=2\r\nRSP/SETUP/200\r\nv=iDataChunk/unicast/tcp/" + strconv.Itoa(freePort(t)) + "\r\nSubmit\r\n"
+
+	// The server answers OPTIONS in plaintext, then asks for TLS on START and expects everything
+	// after it to come over TLS
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- func() error {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			reader := NewMessageReader(conn)
+			if _, err := readTestMessage(reader, MessageRequest, MethodOptions); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte("iRTSP/1.21\r\nSeq=1\r\nRSP/OPTIONS/200\r\nSubmit\r\n")); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte(testMessages[0])); err != nil {
+				return err
+			}
+
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}})
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			if !tlsConn.ConnectionState().HandshakeComplete {
+				return errors.New("TLS handshake not complete")
+			}
+
+			reader = NewMessageReader(tlsConn)
+			if _, err := readTestMessage(reader, MessageResponse, MethodStart); err != nil {
+				return err
+			}
+			if _, err := readTestMessage(reader, MessageRequest, MethodSetup); err != nil {
+				return err
+			}
+			_, err = tlsConn.Write([]byte(setupResponse))
+			return err
+		}()
+	}()
+
+	client, proxy := net.Pipe()
+	session := NewSession()
+	proxyDone := make(chan error, 1)
+	go func() {
+		proxyDone <- proxyIRTSPConnection(proxy, session)
+		proxy.Close()
+	}()
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := NewMessageReader(client)
+
+	if _, err := client.Write([]byte("iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nSubmit\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTestMessage(reader, MessageResponse, MethodOptions); err != nil {
+		t.Fatalf("OPTIONS response: %v", err)
+	}
+
+	start, err := readTestMessage(reader, MessageRequest, MethodStart)
+	if err != nil {
+		t.Fatalf("START request: %v", err)
+	}
+	if scheme := start.Scheme(); scheme != SchemeNone {
+		t.Errorf("START scheme = %s, want %s", scheme, SchemeNone)
+	}
+	if value := start.Headers.Get(HeaderTime); value != "1429051" {
+		t.Errorf("START t = %q, want 1429051", value)
+	}
+
+	// The client never upgrades, so the rest of the session is plaintext on its side
+	if _, err := client.Write([]byte("iRTSP/1.21\r\nSeq=0\r\nRSP/START/200\r\nSubmit\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("iRTSP/1.21\r\nSeq=2\r\nSET/SETUP\r\nSubmit\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTestMessage(reader, MessageResponse, MethodSetup); err != nil {
+		t.Fatalf("SETUP response: %v", err)
+	}
+	if got := reader.Bytes(); !bytes.Equal(got, []byte(setupResponse)) {
+		t.Errorf("SETUP response = %q, want %q", got, setupResponse)
+	}
+
+	if err := <-serverDone; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	client.Close()
+	if err := <-proxyDone; !errors.Is(err, ErrClientConnection) {
+		t.Errorf("proxyIRTSPConnection() = %v, want %v", err, ErrClientConnection)
+	}
+	if session.ServerTLS == nil {
+		t.Error("no TLS with the server")
+	}
+	if session.ClientTLS != nil {
+		t.Error("TLS with the client in client plaintext mode")
+	}
+}
+
+// TestMediaRelay relays a media connection to a loopback server echoing it back, and checks
+// the data comes back whole and is counted both ways
+func TestMediaRelay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(address string) { serverAddress = address }(serverAddress)
+	serverAddress = "127.0.0.1"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The server closes once it echoed the whole stream, as the relay only ends when both
+	// directions do
+	data := bytes.Repeat([]byte("frame"), 2000)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(conn, conn, int64(len(data)))
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	client, proxy := net.Pipe()
+	stats := &MediaConnection{}
+	done := make(chan error, 1)
+	go func() {
+		done <- handleMediaConnection(context.Background(), proxy, "tcp", port, "VIDEO", nil, stats)
+	}()
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	go client.Write(data)
+
+	echoed := make([]byte, len(data))
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Error("echoed data differs from the data sent")
+	}
+
+	client.Close()
+	if err := <-done; err == nil {
+		t.Error("handleMediaConnection() = nil, want why the relay ended")
+	}
+	if stats.RequestBytes.Load() != int64(len(data)) || stats.ResponseBytes.Load() != int64(len(data)) {
+		t.Errorf("relayed %d bytes up and %d down, want %d both ways", stats.RequestBytes.Load(), stats.ResponseBytes.Load(), len(data))
+	}
+}
+
+// TestProxyMessageLimit sends the proxy a client message at the size limit, which is forwarded,
+// and one a byte over it, which the reader stops at and which ends the session
+func TestProxyMessageLimit(t *testing.T) {
+	defer func(size int) { maxMessageSize = size }(maxMessageSize)
+	maxMessageSize = 256
+
+	tests := []struct {
+		name      string
+		size      int
+		forwarded bool
+	}{
+		{"at the limit", 256, true},
+		{"a byte over the limit", 257, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			useTestUpstream(t, listener, false)
+
+			head := "iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nx="
+			tail := "\r\nSubmit\r\n"
+			raw := head + strings.Repeat("a", test.size-len(head)-len(tail)) + tail
+
+			received := make(chan []byte, 1)
+			go func() {
+				defer close(received)
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+				reader := NewMessageReader(conn)
+				if _, err := reader.ReadMessage(); err == nil {
+					received <- bytes.Clone(reader.Bytes())
+				}
+			}()
+
+			client, proxy := net.Pipe()
+			proxyDone := make(chan error, 1)
+			go func() {
+				proxyDone <- proxyIRTSPConnection(proxy, NewSession())
+				proxy.Close()
+			}()
+
+			// The proxy stops reading a message over the limit, so the write doesn't return
+			// until the connection is closed
+			client.SetDeadline(time.Now().Add(10 * time.Second))
+			go client.Write([]byte(raw))
+
+			if !test.forwarded {
+				if err := <-proxyDone; !errors.Is(err, ErrClientParse) || !errors.Is(err, ErrMessageTooLarge) {
+					t.Errorf("proxyIRTSPConnection() = %v, want %v and %v", err, ErrClientParse, ErrMessageTooLarge)
+				}
+				if !strings.Contains(logs.String(), "[SECURITY] Client message over the limits") {
+					t.Errorf("no [SECURITY] line in the log:\n%s", logs.String())
+				}
+				if got, ok := <-received; ok {
+					t.Errorf("server received %q", got)
+				}
+				return
+			}
+
+			// The server closes once it read the message, which ends the session
+			if got := <-received; string(got) != raw {
+				t.Errorf("server received %q, want %q", got, raw)
+			}
+			if err := <-proxyDone; !errors.Is(err, ErrUpstreamConnection) {
+				t.Errorf("proxyIRTSPConnection() = %v, want %v", err, ErrUpstreamConnection)
+			}
+			client.Close()
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// maxLatencySamples is the number of latency samples kept per direction for the percentiles
+const maxLatencySamples = 1000
+
+// defaultSlowThreshold is the processing time above which a forwarded message is logged as slow
+const defaultSlowThreshold = 50 * time.Millisecond
+
+// slowThreshold returns the processing time above which a message is logged as slow. It can be
+// set with the PONSE_SLOW_THRESHOLD env as a Go duration, like "20ms"
+func slowThreshold() time.Duration {
+	value := os.Getenv("PONSE_SLOW_THRESHOLD")
+	if value == "" {
+		return defaultSlowThreshold
+	}
+
+	threshold, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid PONSE_SLOW_THRESHOLD %q, using %v: %v\n", value, defaultSlowThreshold, err)
+		return defaultSlowThreshold
+	}
+
+	return threshold
+}
+
+// stageTimer measures the time the proxy spends on each stage of forwarding a message, from the
+// moment its last byte is read until it's written to the other side. The times use the
+// monotonic clock
+type stageTimer struct {
+	start  time.Time
+	last   time.Time
+	stages []stageTime
+}
+
+// stageTime is the time spent on a single forwarding stage
+type stageTime struct {
+	name     string
+	duration time.Duration
+}
+
+// newStageTimer starts timing a message whose last byte was read at the given time. A message
+// read along with the one before it waits until that one is forwarded, which is its first stage
+func newStageTimer(arrived time.Time) *stageTimer {
+	now := time.Now()
+	if arrived.IsZero() || arrived.After(now) {
+		arrived = now
+	}
+
+	return &stageTimer{start: arrived, last: now, stages: []stageTime{{name: "buffered", duration: now.Sub(arrived)}}}
+}
+
+// mark ends the current stage, giving it a name
+func (t *stageTimer) mark(name string) {
+	now := time.Now()
+	t.stages = append(t.stages, stageTime{name: name, duration: now.Sub(t.last)})
+	t.last = now
+}
+
+// total returns the time spent on all the stages
+func (t *stageTimer) total() time.Duration {
+	return t.last.Sub(t.start)
+}
+
+// slowest returns the stage that took the longest
+func (t *stageTimer) slowest() stageTime {
+	var slowest stageTime
+	for _, stage := range t.stages {
+		if stage.duration > slowest.duration {
+			slowest = stage
+		}
+	}
+
+	return slowest
+}
+
+// warnIfSlow logs a warning naming the slowest stage if the message took longer than the threshold
+func (t *stageTimer) warnIfSlow(source string, threshold time.Duration) {
+	if t.total() <= threshold {
+		return
+	}
+
+	slowest := t.slowest()
+	log.Printf("[%s] WARNING: message took %v to forward, slowest stage was %s (%v)\n", source, t.total(), slowest.name, slowest.duration)
+}
+
+// appendLatency adds a latency sample, dropping the oldest ones past maxLatencySamples
+func appendLatency(samples []time.Duration, latency time.Duration) []time.Duration {
+	samples = append(samples, latency)
+	if len(samples) > maxLatencySamples {
+		samples = samples[len(samples)-maxLatencySamples:]
+	}
+
+	return samples
+}
+
+// describeLatency formats the percentiles of the latency samples
+func describeLatency(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "none"
+	}
+
+	return fmt.Sprintf("p50=%v p95=%v p99=%v (%d samples)", percentile(samples, 50), percentile(samples, 95), percentile(samples, 99), len(samples))
+}
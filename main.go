@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,9 +19,20 @@ import (
 )
 
 var config *tls.Config
+var serverNetwork string
+var serverControlAddress string
 var serverAddress string
 var serverPort string
-var disableTLS bool
+var clientPlaintext bool
+var clientMessageLimit = defaultClientMessageLimit
+var maxMessageSize = defaultMaxMessageSize
+var maxLineSize = defaultMaxLineSize
+var maxHeaders = defaultMaxHeaders
+
+// defaultClientMessageLimit is the largest server message forwarded to the client without a
+// warning. No capture has been measured for this yet, so it matches the read buffer the proxy
+// used before messages were read until their terminator
+const defaultClientMessageLimit = 1024
 
 func main() {
 	log.SetFlags(log.Lshortfile)
@@ -29,14 +43,195 @@ func main() {
 		return
 	}
 
-	disableTLS = len(os.Getenv("PONSE_DISABLE_TLS")) > 0
+	// Read the iRTSP destination address from the PONSE_SERVER_URI env. This can be timed
+	// with an HTTP(S) proxy to get the address before starting the proxy. Example:
+	// irtsp://140.227.187.170:41002
+	//
+	// A unix socket can also be used as the destination (unix:///tmp/server.sock). This is
+	// meant for local testing, so in that case the media connections are made to the
+	// loopback address instead
+	setServerURI(os.Getenv("PONSE_SERVER_URI"))
+
+	// Subcommands only need the destination address
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "speedtest":
+			switch {
+			case len(os.Args) > 3 && os.Args[2] == "serve":
+				err = serveSpeedTestEcho(os.Args[3])
+			case len(os.Args) > 2:
+				err = runSpeedTest(10, os.Args[2])
+			default:
+				err = runSpeedTest(10, "")
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case "audit":
+			if len(os.Args) < 3 {
+				log.Fatalln("usage: ponse audit <file>")
+			}
+			if err := printAuditReport(os.Args[2]); err != nil {
+				log.Fatalln(err)
+			}
+		case "budget":
+			if len(os.Args) > 2 && os.Args[2] == "override" {
+				err = overrideBudget()
+			} else {
+				err = printBudgetStatus()
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case "bundle":
+			selector := "last"
+			if len(os.Args) > 2 {
+				if len(os.Args) != 4 || os.Args[2] != "--session" {
+					log.Fatalln("usage: ponse bundle [--session <id|last>]")
+				}
+				selector = os.Args[3]
+			}
+			path, err := createBundle(selector)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Printf("Bug report bundle written to %s\n", path)
+		case "notify":
+			if len(os.Args) < 3 || os.Args[2] != "test" {
+				log.Fatalln("usage: ponse notify test")
+			}
+			if err := notifyTest(); err != nil {
+				log.Fatalln(err)
+			}
+		case "config":
+			if len(os.Args) < 3 || os.Args[2] != "migrate" {
+				log.Fatalln("usage: ponse config migrate")
+			}
+			env, err := migrateConfig()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println(env)
+		case "vectors":
+			switch {
+			case len(os.Args) > 2 && os.Args[2] == "generate":
+				dir := defaultVectorsDir
+				if len(os.Args) > 3 {
+					dir = os.Args[3]
+				}
+				err = generateVectors(dir)
+			case len(os.Args) > 3 && os.Args[2] == "verify":
+				err = verifyVectors(os.Args[3])
+			default:
+				log.Fatalln("usage: ponse vectors generate [dir] | ponse vectors verify <dir>")
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case "protocol":
+			if len(os.Args) > 2 && os.Args[2] == "export" {
+				err = exportProtocol()
+			} else {
+				err = printProtocol()
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case "upstreams":
+			if err := printUpstreamsReport(); err != nil {
+				log.Fatalln(err)
+			}
+		default:
+			log.Fatalf("unknown command %q\n", os.Args[1])
+		}
+		return
+	}
+
+	// Keep the last lines logged, so that each session record holds its own log
+	log.SetOutput(io.MultiWriter(os.Stderr, proxyLog))
+
+	warnDeprecatedEnvs()
+
+	// In client plaintext mode the client connection is never wrapped in TLS, for clients
+	// that can't do TLS at all. PONSE_DISABLE_TLS is kept as a deprecated alias
+	clientPlaintext = clientPlaintextEnabled()
+
+	// Header keys are split on the first equal sign by default. PONSE_HEADER_SPLIT=last
+	// can be used when the keys contain equal signs instead
+	switch split := os.Getenv("PONSE_HEADER_SPLIT"); split {
+	case "", "first":
+		headerSplit = SplitFirst
+	case "last":
+		headerSplit = SplitLast
+	default:
+		log.Fatalf("unknown header split %q\n", split)
+		return
+	}
+
+	// Bodies start after an empty line by default. PONSE_BODY_DELIMITER=headers starts them at
+	// the first line that can't be a header instead, until we know which one the peers use
+	switch delimiter := os.Getenv("PONSE_BODY_DELIMITER"); delimiter {
+	case "", "blank":
+		bodyDelimiter = BodyAfterBlankLine
+	case "headers":
+		bodyDelimiter = BodyAfterHeaders
+	default:
+		log.Fatalf("unknown body delimiter %q\n", delimiter)
+		return
+	}
+
+	// The client reads control messages into a fixed-size buffer, and desyncs if it receives
+	// a larger one. PONSE_CLIENT_MESSAGE_LIMIT overrides the size above which we warn
+	if limit := os.Getenv("PONSE_CLIENT_MESSAGE_LIMIT"); limit != "" {
+		clientMessageLimit, err = strconv.Atoi(limit)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	// Messages are read until their Submit terminator. PONSE_MAX_MESSAGE_SIZE sets the size
+	// at which we give up on finding it, and drop the connection. PONSE_MAX_LINE_SIZE does the
+	// same for a single line
+	if size := os.Getenv("PONSE_MAX_MESSAGE_SIZE"); size != "" {
+		maxMessageSize, err = strconv.Atoi(size)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	if size := os.Getenv("PONSE_MAX_LINE_SIZE"); size != "" {
+		maxLineSize, err = strconv.Atoi(size)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	// Messages with more header lines than PONSE_MAX_HEADERS are rejected, and the connection
+	// dropped, as a peer can't send that many by mistake
+	if count := os.Getenv("PONSE_MAX_HEADERS"); count != "" {
+		maxHeaders, err = strconv.Atoi(count)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
 	var cer tls.Certificate
-	if !disableTLS {
+	if !clientPlaintext {
 		cer, err = tls.LoadX509KeyPair("server.crt", "server.key")
 		if err != nil {
 			log.Fatalln(err)
 			return
 		}
+
+		// Warn ahead of time, as the client can't connect once the certificate expires
+		if err := checkCertificate(cer); err != nil {
+			log.Fatalln(err)
+			return
+		}
 	}
 
 	config = &tls.Config{
@@ -44,270 +239,839 @@ func main() {
 		InsecureSkipVerify: true,
 	}
 
-	if !disableTLS {
+	if !clientPlaintext {
 		config.Certificates = []tls.Certificate{cer}
 	}
 
-	// Read the iRTSP destination address from the PONSE_SERVER_URI env. This can be timed
-	// with an HTTP(S) proxy to get the address before starting the proxy. Example:
-	// irtsp://140.227.187.170:41002
-	address := os.Getenv("PONSE_SERVER_URI")
-	filteredAddress, _ := strings.CutPrefix(address, "irtsp://")
-	serverAddress, serverPort, _ = strings.Cut(filteredAddress, ":")
+	mediaPool = newRelayPool(mediaWorkers())
+	startDebugServer()
 
-	ln, err := net.Listen("tcp", ":" + serverPort)
+	listenAddresses, err := listenAddressList()
 	if err != nil {
-		log.Println(err)
+		log.Fatalln(err)
 		return
 	}
-	defer ln.Close()
 
+	// Bind every address before accepting anything, so that a typo in any of them stops
+	// the proxy instead of leaving it listening on only some of the addresses
+	var listeners []net.Listener
+	for _, entry := range strings.Split(listenAddresses, ",") {
+		listenNetwork, listenAddress := parseListenAddress(strings.TrimSpace(entry))
+
+		if listenNetwork == "unix" {
+			// Remove the socket left behind by a previous run, if any
+			if err := os.Remove(listenAddress); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Fatalf("failed to listen on %s: %v\n", entry, err)
+				return
+			}
+		}
+
+		ln, err := net.Listen(listenNetwork, listenAddress)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v\n", entry, err)
+			return
+		}
+		defer ln.Close()
+
+		listeners = append(listeners, ln)
+	}
+
+	for _, ln := range listeners[1:] {
+		go acceptIRTSPConnections(ln)
+	}
+	acceptIRTSPConnections(listeners[0])
+}
+
+// acceptIRTSPConnections accepts the client connections of a listener, and proxies each of
+// them on its own goroutine
+func acceptIRTSPConnections(ln net.Listener) {
+	log.Printf("Listening on %s\n", ln.Addr())
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		go handleIRTSPConnection(conn)
+		go handleIRTSPConnection(conn, ln.Addr().String())
 	}
 }
 
-func handleIRTSPConnection(conn net.Conn) {
+func handleIRTSPConnection(conn net.Conn, listener string) {
 	defer conn.Close()
-	serverConn, err := net.Dial("tcp", serverAddress + ":" + serverPort)
-	if err != nil {
-		log.Println(err)
+	logMark := proxyLog.mark()
+	session := NewSession()
+	session.Listener = listener
+	assignSessionIDs(session, conn.RemoteAddr())
+	addSession(session)
+	defer removeSession(session)
+	start := time.Now()
+	err := proxyIRTSPConnection(conn, session)
+	session.EndReason = sessionEndReason(err)
+	session.Protocol.stop(session.EndReason)
+	if session.EndReason == EndHandshakeFailed {
+		session.Escalation.fire(TriggerHandshakeFailed, err)
+	}
+	session.Escalation.finish()
+	log.Printf("iRTSP session %d (connection %d) with %s on %s ended (reason=%s): %v\n", session.LogicalID, session.ID, conn.RemoteAddr(), listener, session.EndReason, err)
+	if session.Reconnects > 0 {
+		log.Printf("[SESSION] Session %d reconnected %d times\n", session.LogicalID, session.Reconnects)
+	}
+	recordSessionEnd(session, conn.RemoteAddr(), !errors.Is(err, io.EOF) && !errors.Is(err, ErrBudgetExceeded))
+	stats := session.Stats()
+	for _, line := range stats {
+		log.Printf("[SESSION] %s\n", line)
+	}
+
+	switch {
+	case errors.Is(err, ErrBudgetExceeded):
+		notify(EventBudgetExhausted, err.Error())
+	case errors.Is(err, ErrUpstreamDial):
+		notify(EventUpstreamUnreachable, err.Error())
+	case err != nil && !errors.Is(err, io.EOF):
+		notify(EventSessionError, err.Error())
+	}
+	recordSession(session, conn.RemoteAddr(), start, stats, logMark, err)
+
+	// The upstream wasn't dialed, so there is nothing to record
+	if errors.Is(err, ErrBudgetExceeded) {
 		return
 	}
+
+	if err := recordUpstreamSession(serverControlAddress, session, time.Since(start), err); err != nil {
+		log.Printf("Failed to record upstream history: %v\n", err)
+	}
+}
+
+// recordSession saves the record of an ended session for the bug report bundle, with the lines
+// logged since logMark
+func recordSession(session *Session, client net.Addr, start time.Time, stats []string, logMark int64, err error) {
+	record := SessionRecord{
+		ID:        session.ID,
+		LogicalID: session.LogicalID,
+		Client:    client.String(),
+		Listener:  session.Listener,
+		Upstream:  serverControlAddress,
+		Start:     start,
+		End:       time.Now(),
+		EndReason: session.EndReason,
+		Summary:   session.Summary(),
+		Stats:     stats,
+		Log:       proxyLog.since(logMark),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if err := saveSessionRecord(record); err != nil {
+		log.Printf("Failed to record session %d: %v\n", session.ID, err)
+	}
+}
+
+// proxyIRTSPConnection proxies the iRTSP messages between the client and the server until
+// either side fails. The returned error wraps one of the proxy errors, so the cause of the
+// session ending can be checked with errors.Is
+func proxyIRTSPConnection(conn net.Conn, session *Session) error {
+	// Refuse to dial the server once the budget is used up. If the budget can't be read,
+	// don't risk the play time either
+	if err := reserveUpstreamAttempt(); err != nil {
+		if errors.Is(err, ErrBudgetExceeded) {
+			rejectClient(conn, EndBudgetExhausted)
+		}
+		return err
+	}
+
+	serverConn, err := net.Dial(serverNetwork, serverControlAddress)
+	if err != nil {
+		rejectClient(conn, EndUpstreamUnreachable)
+		return fmt.Errorf("%w: %w", ErrUpstreamDial, err)
+	}
 	defer serverConn.Close()
-	for {
-		buffer := make([]byte, 1024)
 
+	// Count the bytes on the wire below the TLS layer, and the decrypted ones on top of it.
+	// The wire counters stay with the raw connections when they are upgraded
+	clientWire := &countingConn{Conn: conn, counter: &session.ClientBytes.Wire}
+	serverWire := &countingConn{Conn: serverConn, counter: &session.ServerBytes.Wire}
+	conn = &countingConn{Conn: clientWire, counter: &session.ClientBytes.App}
+	serverConn = &countingConn{Conn: serverWire, counter: &session.ServerBytes.App}
+
+	// Keep the address of the plain connection, as media source ports can be relative to it
+	controlAddr := serverConn.LocalAddr()
+
+	// The media connections are bound to the session, and stop when it ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Label the goroutines with the session, so that profiles can be attributed to it. The
+	// goroutines started from here inherit the label
+	ctx = pprof.WithLabels(ctx, pprof.Labels("session", strconv.FormatInt(session.ID, 10)))
+	pprof.SetGoroutineLabels(ctx)
+
+	// The media connections are shut down before the control connections are closed
+	media := newMediaGroup(ctx, session.ID, conn.RemoteAddr(), serverConn.RemoteAddr())
+	defer media.shutdown(session)
+
+	threshold := slowThreshold()
+
+	// The readers are replaced when the connections are upgraded to TLS
+	clientReader := NewMessageReader(conn)
+	serverReader := NewMessageReader(serverConn)
+
+	// Some servers speak first right after connecting. The client isn't read on the first
+	// pass, so that a greeting is forwarded before the client's first request
+	waitGreeting := true
+	for {
 		// TODO - With this hack we change between client->server and server->client messages faster
 		// when doing everything on the same goroutine. Split interactions into separate goroutines
 		// and make TLS not break in the process
-		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, err := conn.Read(buffer)
-		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
-			log.Println(n, err)
-			break
+		session.RoundTrips.expire(time.Now())
+
+		var buffer []byte
+		var req *Message
+		if !waitGreeting {
+			// Don't wait long when the server already sent more than one message
+			clientTimeout := 1 * time.Second
+			if serverReader.Buffered() {
+				clientTimeout = pendingReadTimeout
+			}
+
+			conn.SetReadDeadline(time.Now().Add(clientTimeout))
+			req, err = clientReader.ReadMessage()
+			buffer = clientReader.Bytes()
+
+			// A message over the limits ends the session, whether the reader stopped at them
+			// before the message was whole or it was read and failed to parse
+			if overLimit(err) {
+				log.Printf("[SECURITY] Client message over the limits, closing the connection: %v\n", err)
+				return fmt.Errorf("%w: %w", ErrClientParse, err)
+			}
+			if err != nil && buffer == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return fmt.Errorf("%w: %w", ErrClientConnection, err)
+			}
 		}
-		buffer = buffer[:n]
 
 		if len(buffer) > 0 {
-			req := NewMessage(buffer)
-			log.Printf("%+v\n", req)
+			frame := clientReader.Frame()
+			timer := newStageTimer(frame.End)
+			session.ClientBytes.recordMessage(frame)
+			session.Escalation.record("CLIENT", buffer)
 
-			n, err = serverConn.Write(req.ToBytes())
+			// A message that can't be parsed is forwarded as received, as the proxy has no
+			// reason to change it. The bytes written are kept for the audit
+			forwarded := &auditWriter{writer: serverConn}
 			if err != nil {
-				log.Println(n, err)
-				break
+				log.Printf("[ANOMALY] %v, forwarding it as received: %q\n", fmt.Errorf("%w: %w", ErrClientParse, err), buffer)
+				session.Escalation.fire(TriggerParseError, err)
+				_, err = writeFull(forwarded, buffer)
+			} else {
+				req.Direction = "CLIENT"
+				log.Printf("[CLIENT] %s\n", req)
+				logBody(req)
+				session.observeHeaders(req)
+				session.ClientSequence.observe(req)
+				session.RoundTrips.observe(req)
+				session.Ticks.observe(req)
+				observeMessage(req)
+				logProblems(req)
+				_, err = req.WriteTo(forwarded)
+			}
+			timer.mark("write")
+			auditForward("CLIENT", buffer, forwarded.written, nil)
+			timer.mark("audit")
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrUpstreamConnection, err)
 			}
+			session.recordLatency("CLIENT", timer.total())
+			timer.warnIfSlow("CLIENT", threshold)
 
-			// The client can also send response messages, so we check the message type for logging
-			var messageType string
-			if req.Code > 0 {
-				messageType = "response"
-			} else {
-				messageType = "request"
+			if req != nil {
+				logMessage(req)
 			}
+		}
 
-			log.Printf("[CLIENT] iRTSP %s:\n", messageType)
-			fmt.Printf("%s\n", req.ToBytes())
+		// Only wait shortly for a greeting, as most servers wait for the client instead
+		serverTimeout := 1 * time.Second
+		if waitGreeting {
+			serverTimeout = 200 * time.Millisecond
+			waitGreeting = false
+		}
+		if clientReader.Buffered() {
+			serverTimeout = pendingReadTimeout
 		}
 
-		serverConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		buffer = make([]byte, 1024)
-		n, err = serverConn.Read(buffer)
-		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
-			log.Println(n, err)
-			break
+		serverConn.SetReadDeadline(time.Now().Add(serverTimeout))
+		res, err := serverReader.ReadMessage()
+		buffer = serverReader.Bytes()
+		if overLimit(err) {
+			log.Printf("[SECURITY] Server message over the limits, closing the connection: %v\n", err)
+			return fmt.Errorf("%w: %w", ErrServerParse, err)
+		}
+		if err != nil && buffer == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: %w", ErrUpstreamConnection, err)
 		}
-		buffer = buffer[:n]
 
 		if len(buffer) > 0 {
-			res := NewMessage(buffer)
-			log.Printf("%+v\n", res)
-
-			// When we receive the stream media ports, start a connection on those ports
-			// for proxying the data
-			if res.Method == "SETUP" {
-				videoHeader := res.Headers["v"]
-				startMediaConnection(videoHeader, "VIDEO")
-				audioHeader := res.Headers["a"]
-				// TODO - Is this even possible?
-				if audioHeader != videoHeader {
-					startMediaConnection(audioHeader, "AUDIO")
-				}
-				controlHeader := res.Headers["c"]
-				if controlHeader != videoHeader && controlHeader != audioHeader {
-					startMediaConnection(controlHeader, "CONTROL")
+			frame := serverReader.Frame()
+			timer := newStageTimer(frame.End)
+			session.ServerBytes.recordMessage(frame)
+			session.Escalation.record("SERVER", buffer)
+			if err != nil {
+				// Nothing in the message can be acted upon, so it's forwarded as received
+				log.Printf("[ANOMALY] %v, forwarding it as received: %q\n", fmt.Errorf("%w: %w", ErrServerParse, err), buffer)
+				session.Escalation.fire(TriggerParseError, err)
+				auditForward("SERVER", buffer, buffer, nil)
+				if _, err := writeFull(conn, buffer); err != nil {
+					return fmt.Errorf("%w: %w", ErrClientConnection, err)
 				}
+				session.recordLatency("SERVER", timer.total())
+				continue
+			}
+			res.Direction = "SERVER"
+			log.Printf("[SERVER] %s\n", res)
+			logBody(res)
+			session.observeHeaders(res)
+			session.ServerSequence.observe(res)
+			session.RoundTrips.observe(res)
+			session.Ticks.observe(res)
+			observeMessage(res)
+			logProblems(res)
+			reentered := session.Protocol.observe(res)
+			session.Version = res.Version
+			session.recordResponse(res)
+			if session.Timer != nil {
+				session.Timer.Observe(&res.Headers)
 			}
 
-			// When we receive the KNOCK port, start a connection on it for proxying
-			// the data
-			// The KNOCK header looks like this:
+			// Media announced over a transport the proxy doesn't know is handled following
+			// the PONSE_UNKNOWN_TRANSPORT policy. The media are relayed and the message is
+			// forwarded as the policy left them, res staying as received
+			relayed, transportMutation, err := applyTransportPolicy(res)
+			if err != nil {
+				log.Printf("[ANOMALY] %v, answering the client with an error instead\n", err)
+				relayed = transportFailure(res)
+				transportMutation = "unknown transport failed"
+			}
+
+			// Media connections announced by this message are held until it reaches the client
+			gate := newMediaGate(res.Method)
+
+			// When we receive media ports, like the streams on SETUP or the KNOCK port, start
+			// a connection on those ports for proxying the data. The transports look like this:
 			// iDataChunk/unicast/tcp/40605;
-			// So we trim the ; at the end
-			if res.Method == "KNOCK" {
-				knockHeader := res.Headers["p"]
-				startMediaConnection(strings.TrimRight(knockHeader, ";"), "KNOCK")
-			}
-
-			if res.Method == "START" && disableTLS {
-				// The server controls whether the client should do a TLS handshake
-				// with the "scheme" header
-				// Disable TLS on the client by clearing out the header
-				if scheme, ok := res.Headers["sc"]; ok && scheme == "tls" {
-					res.Headers["sc"] = ""
+			// The ; at the end is dropped when it's parsed
+			info := methodInfo(res.Method)
+
+			// Servers can repeat a header, so every value is started. A port announced more
+			// than once, even for another kind, is a single listener, so only the first kind
+			// announcing it starts it
+			started := make(map[string]bool)
+			for _, announced := range info.Media {
+				first := true
+				for _, header := range relayed.Headers.Values(announced.Header) {
+					if started[header] {
+						continue
+					}
+					started[header] = true
+
+					if first {
+						session.recordMedia(announced.Kind, header)
+						first = false
+					}
+					transport, err := ParseTransport(header)
+					if err != nil {
+						log.Printf("%v: %s: %v\n", ErrMediaBind, announced.Kind, err)
+						continue
+					}
+					if err := startMediaConnection(media, transport, announced.Kind, controlAddr, gate); err != nil {
+						log.Println(err)
+					}
 				}
 			}
 
-			n, err = conn.Write(res.ToBytes())
-			if err != nil {
-				log.Println(n, err)
-				break
+			// A START after the session has already been started must not upgrade the
+			// connections again, as they are already wrapped in TLS
+			renegotiation := info.StartsSession && reentered
+			if renegotiation {
+				log.Printf("[SESSION] Re-negotiation observed:\n%s\n", res.Verbose())
+				if scheme := res.Scheme(); scheme != session.Scheme {
+					log.Printf("[SESSION] WARNING: scheme changed on re-negotiation from %s to %s, ignoring\n", session.Scheme, scheme)
+				}
+			} else if info.StartsSession {
+				session.Scheme = res.Scheme()
 			}
 
-			// The server can also send request messages, so we check the message type for logging
-			var messageType string
-			if res.Code > 0 {
-				messageType = "response"
-			} else {
-				messageType = "request"
+			timer.mark("session handling")
+
+			// Features changing the message before it's forwarded, for the audit log
+			var mutations []string
+			if transportMutation != "" {
+				mutations = append(mutations, transportMutation)
 			}
 
-			log.Printf("[SERVER] iRTSP %s:\n", messageType)
-			fmt.Printf("%s\n", res.ToBytes())
+			// The changes are made on a copy, so that the message as received stays
+			// available to the session handling below
+			forward, cleared := plaintextForClient(relayed)
+			if cleared {
+				mutations = append(mutations, "client plaintext mode (sc header cleared)")
+			}
 
-			// When we receive the START response from the server, do the TLS handshake.
-			// TODO - This assumes that the server wants a TLS handshake
-			if res.Method == "START" {
-				if !disableTLS {
-					conn = tls.Server(conn, config)
+			// Messages we changed on purpose use canonical line endings, the rest are
+			// forwarded as they came. The bytes written are kept for the audit
+			timer.mark("rewrite")
+			forwarded := &auditWriter{writer: conn}
+			_, err = forward.WriteTo(forwarded)
+			gate.open(err == nil)
+			timer.mark("write")
+			if size := len(forwarded.written); size > clientMessageLimit {
+				log.Printf("[SERVER] WARNING: %v: %s is %d bytes, the client limit is %d\n", ErrMessageTooLarge, res.Method, size, clientMessageLimit)
+			}
+			auditForward("SERVER", buffer, forwarded.written, mutations)
+			timer.mark("audit")
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrClientConnection, err)
+			}
+			session.recordLatency("SERVER", timer.total())
+			timer.warnIfSlow("SERVER", threshold)
+
+			logMessage(res)
+
+			// When we receive the START response from the server, do the TLS handshake if
+			// the server asked for it with the scheme header. The upstream side always
+			// follows the server, even in client plaintext mode
+			if info.StartsSession && !renegotiation {
+				if session.Scheme.IsTLS() {
+					// Some peers are asked to upgrade and keep going in plaintext. If the fallback
+					// is enabled, each side stays in plaintext on its own when that happens
+					// Bytes read ahead of the START messages already belong to the handshake
+					if !clientPlaintext {
+						recorder := &handshakeRecorder{Conn: withPending(clientWire, clientReader.Unread())}
+						tlsConn := tls.Server(recorder, config)
+						err := handshake(tlsConn)
+						recorder.done = true
+						if err != nil {
+							plainConn, ok := plaintextFallback(err, recorder)
+							if !ok {
+								return fmt.Errorf("%w: %w: %w", ErrHandshake, ErrClientConnection, err)
+							}
+							log.Printf("[ANOMALY] The client didn't upgrade to TLS and kept sending plaintext, falling back to plaintext with it: %v\n", err)
+							conn = &countingConn{Conn: plainConn, counter: &session.ClientBytes.App}
+						} else {
+							conn = &countingConn{Conn: tlsConn, counter: &session.ClientBytes.App}
+							clientState := tlsConn.ConnectionState()
+							session.ClientTLS = &clientState
+						}
+						clientReader = NewMessageReader(conn)
+					}
+					recorder := &handshakeRecorder{Conn: withPending(serverWire, serverReader.Unread())}
+					tlsServerConn := tls.Client(recorder, config)
+					handshakeStart := time.Now()
+					err := handshake(tlsServerConn)
+					recorder.done = true
+					if err != nil {
+						plainConn, ok := plaintextFallback(err, recorder)
+						if !ok {
+							return fmt.Errorf("%w: %w: %w", ErrHandshake, ErrUpstreamConnection, err)
+						}
+						log.Printf("[ANOMALY] The server asked for TLS but kept sending plaintext, falling back to plaintext with it: %v\n", err)
+						serverConn = &countingConn{Conn: plainConn, counter: &session.ServerBytes.App}
+					} else {
+						session.HandshakeLatency = time.Since(handshakeStart)
+						serverConn = &countingConn{Conn: tlsServerConn, counter: &session.ServerBytes.App}
+						serverState := tlsServerConn.ConnectionState()
+						session.ServerTLS = &serverState
+					}
+					serverReader = NewMessageReader(serverConn)
 				}
-				serverConn = tls.Client(serverConn, config)
+
+				log.Printf("[SESSION] Established: %s\n", session.Summary())
 			}
 		}
 	}
 }
 
-func startMediaConnection(header, kind string) {
-	// A media header consists of 4 sections:
-	// iDataChunk/unicast/tcp/40603
-	// 1. The streaming type: "iDataChunk"
-	// 2. The delivery type: "unicast" (or "multicast"?)
-	// 3. The transmission protocol used: "tcp" or "ust"
-	// 4. The server port: "40603"
-	headerStrings := strings.Split(header, "/")
-	port := headerStrings[len(headerStrings)-1] // Extract the port from the last section
-	network := headerStrings[len(headerStrings)-2] // Extract the network from the third section
-
-	// UST is a custom network protocol over UDP. It is used as a "slow connection" mode,
-	// but the UST payload is the same as in TCP mode
-	if network == "ust" {
-		network = "udp"
-		portInt, err := strconv.Atoi(port)
+// handshake runs the TLS handshake on the connection, so that handshake failures can be
+// told apart from regular read and write errors
+func handshake(conn *tls.Conn) error {
+	// Clear any read deadline left on the underlying connection, and give the peer a
+	// reasonable amount of time to complete the handshake instead
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	return conn.Handshake()
+}
+
+// setServerURI sets the destination server from PONSE_SERVER_URI, like
+// irtsp://140.227.187.170:41002, or unix:///tmp/server.sock for a unix socket, in which case the
+// media connections are made to the loopback address
+func setServerURI(uri string) {
+	if socketPath, ok := strings.CutPrefix(uri, "unix://"); ok {
+		serverNetwork = "unix"
+		serverControlAddress = socketPath
+		serverAddress = "127.0.0.1"
+		serverPort = ""
+		return
+	}
+
+	filteredAddress, _ := strings.CutPrefix(uri, "irtsp://")
+	serverAddress, serverPort, _ = strings.Cut(filteredAddress, ":")
+	serverNetwork = "tcp"
+	serverControlAddress = serverAddress + ":" + serverPort
+}
+
+// listenAddressList returns the addresses the proxy listens on. By default the proxy listens on
+// the same port as the destination server, as the client expects it. PONSE_LISTEN_ADDR can
+// override this with a comma-separated list of TCP addresses (192.168.1.2:41002) or unix sockets
+// (unix:///tmp/ponse.sock), and the proxy listens on all of them
+func listenAddressList() (string, error) {
+	if addresses := os.Getenv("PONSE_LISTEN_ADDR"); addresses != "" {
+		return addresses, nil
+	}
+
+	if serverNetwork == "unix" {
+		return "", errors.New("PONSE_LISTEN_ADDR must be set when PONSE_SERVER_URI is a unix socket")
+	}
+
+	return ":" + serverPort, nil
+}
+
+// parseListenAddress splits a listen address into the network and the address to be passed
+// to net.Listen. Addresses prefixed with "unix://" are unix socket paths, anything else is
+// treated as a TCP address
+func parseListenAddress(address string) (string, string) {
+	if socketPath, ok := strings.CutPrefix(address, "unix://"); ok {
+		return "unix", socketPath
+	}
+
+	return "tcp", strings.TrimPrefix(address, "tcp://")
+}
+
+// startMediaConnection starts relaying a media connection announced by the server, listening
+// for the client on the port of the transport
+func startMediaConnection(media *mediaGroup, transport TransportInfo, kind string, controlAddr net.Addr, gate *mediaGate) error {
+	if !transport.Known() {
+		return fmt.Errorf("%w: %s: %w %q, the header is forwarded without relaying the media", ErrMediaBind, kind, ErrUnknownTransport, transport.Protocol)
+	}
+	port := strconv.Itoa(transport.Port)
+	network := transport.Network()
+
+	if network == "udp" {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: transport.Port})
 		if err != nil {
-			log.Println(err)
-			return
+			return fmt.Errorf("%w: %s: %w", ErrMediaBind, kind, err)
 		}
 
-		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: portInt})
-		if err != nil {
-			log.Println(err)
-			return
+		stats := media.connection(kind, nil)
+		relay, ok := media.track(func() {
+			defer media.end(stats)
+			if !gate.wait(kind, nil) {
+				conn.Close()
+				return
+			}
+			err := handleMediaConnection(media.relaying, &sourceCheckedUDP{UDPConn: conn, media: media, kind: kind, rejected: make(map[string]bool), stats: stats}, network, port, kind, controlAddr, stats)
+			log.Printf("[%s] Relay ended: %v\n", kind, err)
+		})
+		if !ok {
+			conn.Close()
+			return nil
 		}
 
-		go handleMediaConnection(conn, network, port, kind)
-		return
+		go relay()
+		return nil
 	}
 
 	ln, err := net.Listen(network, ":" + port)
 	if err != nil {
-		log.Println(err)
-		return
+		return fmt.Errorf("%w: %s: %w", ErrMediaBind, kind, err)
 	}
 
+	// Stop accepting media connections once the session ends
+	context.AfterFunc(media.accepting, func() { ln.Close() })
+
 	go func() {
 		defer ln.Close()
 		for {
 			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				log.Println(err)
 				continue
 			}
-			go handleMediaConnection(conn, network, port, kind)
+			if !media.allows(conn.RemoteAddr()) {
+				media.logRejected(kind, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+
+			// The media listeners are for the client. A connection from the server has no
+			// client-facing side to be relayed to, as the proxy can't connect to the client,
+			// and relaying it to the server would loop it back
+			initiator := media.initiator(conn.RemoteAddr())
+			if initiator == InitiatorUpstream {
+				log.Printf("[ANOMALY] %s connection of session %d opened by the server from %s, closing it\n", kind, media.session, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			if initiator == InitiatorUnknown {
+				log.Printf("[ANOMALY] %s connection of session %d opened from %s, which is neither the client %s nor the server\n", kind, media.session, conn.RemoteAddr(), media.client)
+			}
+
+			stats := media.connection(kind, conn.RemoteAddr())
+			relay, ok := media.track(func() {
+				defer media.end(stats)
+				if !gate.wait(kind, conn) {
+					conn.Close()
+					return
+				}
+				err := handleMediaConnection(media.relaying, conn, network, port, kind, controlAddr, stats)
+				log.Printf("[%s] Relay with %s ended: %v\n", kind, conn.RemoteAddr(), err)
+			})
+			if !ok {
+				conn.Close()
+				return
+			}
+
+			if pooledKind(kind) {
+				mediaPool.submit(relay)
+			} else {
+				go relay()
+			}
 		}
 	}()
+
+	return nil
 }
 
-func handleMediaConnection(conn net.Conn, network, port, kind string) {
-	serverConn, err := net.Dial(network, serverAddress + ":" + port)
+// handleMediaConnection relays a media connection to the server until both directions stop,
+// and returns why the relay ended: the cause of the context being canceled (including the idle
+// timeout and the maximum lifetime), io.EOF if a peer closed the connection, or the error of
+// the first direction that failed. The bytes relayed each way are counted in stats
+func handleMediaConnection(ctx context.Context, conn net.Conn, network, port, kind string, controlAddr net.Addr, stats *MediaConnection) error {
+	defer conn.Close()
+
+	dialer, err := mediaDialer(network, kind, controlAddr)
 	if err != nil {
-		log.Println(err)
-		return
+		return fmt.Errorf("%w: %w", ErrUpstreamDial, err)
 	}
 
+	serverConn, err := dialer.Dial(network, serverAddress + ":" + port)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUpstreamDial, err)
+	}
+
+	strategy := relayStrategy(kind, network)
+
+	// Log the source port, so that the server accepting or rejecting the connection can
+	// be correlated with it
+	log.Printf("[%s] Connected to %s from %s (%s relay)\n", kind, serverConn.RemoteAddr(), serverConn.LocalAddr(), strategy)
+
 	defer serverConn.Close()
+
+	// Once the relay is done, give both connections an immediate deadline so that the
+	// pending reads return
+	relayCtx, cancel, touch := mediaRelayContext(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(relayCtx, func() {
+		now := time.Now()
+		conn.SetDeadline(now)
+		serverConn.SetDeadline(now)
+	})
+	defer stop()
+
+	// The reason of the first direction to stop is the reason of the relay
+	var endOnce sync.Once
+	var endErr error
+	end := func(err error) {
+		endOnce.Do(func() { endErr = err })
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func(wg *sync.WaitGroup) {
-		for {
-			buffer := make([]byte, 1024)
-			n, err := conn.Read(buffer)
-			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		defer wg.Done()
+		runRelay(relayCtx, kind, "request", port, &stats.RequestBytes, func(add func(n int)) {
+			if strategy == RelayFast {
+				// Tracking the activity means the data has to go through the proxy, so the
+				// copy is only wrapped when there is an idle timeout
+				var reader io.Reader = conn
+				if touch != nil {
+					reader = &touchReader{reader: conn, touch: touch}
+				}
+				n, err := io.Copy(serverConn, reader)
+				add(int(n))
 				log.Println(n, err)
-				break
+				end(relayEndReason(relayCtx, err))
+				return
 			}
-			buffer = buffer[:n]
 
-			if len(buffer) > 0 {
-				// TODO - Investigate why UDP isn't working
-				if network == "udp" {
-					n, err = conn.(*net.UDPConn).WriteTo(buffer, serverConn.RemoteAddr())
-				} else {
-					n, err = serverConn.Write(buffer)
+			// Time each chunk from the read until it's written to the other side
+			var latencies []time.Duration
+			empty := &emptyReads{}
+			shortDatagrams := 0
+			decoder := newFrameDecoder(kind, "request")
+			pooled := mediaBuffers.Get().(*[]byte)
+			defer mediaBuffers.Put(pooled)
+			defer func() {
+				log.Printf("[%s] Media request latency: %s\n", kind, describeLatency(latencies))
+				if decoder != nil {
+					log.Printf("[%s] Media request frames: %s\n", kind, decoder.Summary())
 				}
-				if err != nil {
+				log.Printf("[%s] Media request empty reads: %d, empty datagrams: %d, short datagrams: %d\n", kind, empty.reads, empty.datagrams, shortDatagrams)
+			}()
+
+			for {
+				buffer := *pooled
+				n, err := conn.Read(buffer)
+				if relayCtx.Err() != nil {
+					end(context.Cause(relayCtx))
+					break
+				}
+				if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
 					log.Println(n, err)
+					end(relayEndReason(relayCtx, err))
 					break
 				}
+				buffer = buffer[:n]
+
+				forward := len(buffer) > 0
+				if err == nil {
+					forward, err = empty.check(network, n)
+					if err != nil {
+						log.Printf("[%s] %v\n", kind, err)
+						end(err)
+						break
+					}
+				}
 
-				log.Printf("[%s] Media request:\n", kind)
-				// fmt.Printf("%x\n", buffer)
+				if forward {
+					start := time.Now()
+					// TODO - Investigate why UDP isn't working
+					if network == "udp" {
+						n, err = conn.(net.PacketConn).WriteTo(buffer, serverConn.RemoteAddr())
+						// A datagram is sent whole or not at all, so a different length means
+						// something between us and the socket altered it
+						if err == nil && n != len(buffer) {
+							shortDatagrams++
+							log.Printf("[%s] Sent %d bytes of a %d byte datagram\n", kind, n, len(buffer))
+						}
+					} else {
+						n, err = writeFull(serverConn, buffer)
+					}
+					if err != nil {
+						log.Println(n, err)
+						end(relayEndReason(relayCtx, err))
+						break
+					}
+					latencies = appendLatency(latencies, time.Since(start))
+					add(n)
+					if decoder != nil {
+						decoder.feed(buffer)
+					}
+					if touch != nil {
+						touch()
+					}
+
+					log.Printf("[%s] Media request:\n", kind)
+					if strategy == RelayInspected {
+						fmt.Printf("%x\n", buffer)
+					}
+				}
 			}
-		}
-		wg.Done()
+		})
 	}(wg)
 	go func(wg *sync.WaitGroup) {
-		for {
-			buffer := make([]byte, 1024)
-			n, err := serverConn.Read(buffer)
-			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		defer wg.Done()
+		runRelay(relayCtx, kind, "response", port, &stats.ResponseBytes, func(add func(n int)) {
+			if strategy == RelayFast {
+				// Tracking the activity means the data has to go through the proxy, so the
+				// copy is only wrapped when there is an idle timeout
+				var reader io.Reader = serverConn
+				if touch != nil {
+					reader = &touchReader{reader: serverConn, touch: touch}
+				}
+				n, err := io.Copy(conn, reader)
+				add(int(n))
 				log.Println(n, err)
-				break
+				end(relayEndReason(relayCtx, err))
+				return
 			}
-			buffer = buffer[:n]
 
-			if len(buffer) > 0 {
-				// TODO - Investigate why UDP isn't working
-				if network == "udp" {
-					n, err = serverConn.(*net.UDPConn).WriteTo(buffer, conn.RemoteAddr())
-				} else {
-					n, err = conn.Write(buffer)
+			// Time each chunk from the read until it's written to the other side
+			var latencies []time.Duration
+			empty := &emptyReads{}
+			shortDatagrams := 0
+			decoder := newFrameDecoder(kind, "response")
+			pooled := mediaBuffers.Get().(*[]byte)
+			defer mediaBuffers.Put(pooled)
+			defer func() {
+				log.Printf("[%s] Media response latency: %s\n", kind, describeLatency(latencies))
+				if decoder != nil {
+					log.Printf("[%s] Media response frames: %s\n", kind, decoder.Summary())
+				}
+				log.Printf("[%s] Media response empty reads: %d, empty datagrams: %d, short datagrams: %d\n", kind, empty.reads, empty.datagrams, shortDatagrams)
+			}()
+
+			for {
+				buffer := *pooled
+				n, err := serverConn.Read(buffer)
+				if relayCtx.Err() != nil {
+					end(context.Cause(relayCtx))
+					break
 				}
-				if err != nil {
+				if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
 					log.Println(n, err)
+					end(relayEndReason(relayCtx, err))
 					break
 				}
+				buffer = buffer[:n]
+
+				forward := len(buffer) > 0
+				if err == nil {
+					forward, err = empty.check(network, n)
+					if err != nil {
+						log.Printf("[%s] %v\n", kind, err)
+						end(err)
+						break
+					}
+				}
+
+				if forward {
+					start := time.Now()
+					// TODO - Investigate why UDP isn't working
+					if network == "udp" {
+						n, err = serverConn.(net.PacketConn).WriteTo(buffer, conn.RemoteAddr())
+						// A datagram is sent whole or not at all, so a different length means
+						// something between us and the socket altered it
+						if err == nil && n != len(buffer) {
+							shortDatagrams++
+							log.Printf("[%s] Sent %d bytes of a %d byte datagram\n", kind, n, len(buffer))
+						}
+					} else {
+						n, err = writeFull(conn, buffer)
+					}
+					if err != nil {
+						log.Println(n, err)
+						end(relayEndReason(relayCtx, err))
+						break
+					}
+					latencies = appendLatency(latencies, time.Since(start))
+					add(n)
+					if decoder != nil {
+						decoder.feed(buffer)
+					}
+					if touch != nil {
+						touch()
+					}
 
-				log.Printf("[%s] Media response:\n", kind)
-				// fmt.Printf("%x\n", buffer)
+					log.Printf("[%s] Media response:\n", kind)
+					if strategy == RelayInspected {
+						fmt.Printf("%x\n", buffer)
+					}
+				}
 			}
-		}
-		wg.Done()
+		})
 	}(wg)
 	wg.Wait()
+
+	return endErr
 }
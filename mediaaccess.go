@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+)
+
+// strictMediaSource returns whether media connections are only relayed when they come from the
+// IP of the client of the session, set with the PONSE_MEDIA_STRICT_SOURCE env
+func strictMediaSource() bool {
+	return len(os.Getenv("PONSE_MEDIA_STRICT_SOURCE")) > 0
+}
+
+// allows returns whether a media connection from addr can be relayed for the session. Each
+// listener belongs to the session that announced its port, but anyone on the network can
+// connect to it, and would have its bytes relayed to the server of that session. Clients on a
+// unix socket have no IP to compare, so they aren't checked
+func (g *mediaGroup) allows(addr net.Addr) bool {
+	if !strictMediaSource() || net.ParseIP(g.client) == nil {
+		return true
+	}
+
+	return clientIP(addr) == g.client
+}
+
+// logRejected logs a media connection or datagram that was rejected by allows
+func (g *mediaGroup) logRejected(kind string, addr net.Addr) {
+	log.Printf("[SECURITY] Rejected %s connection from %s: session %d belongs to %s\n", kind, addr, g.session, g.client)
+}
+
+// sourceCheckedUDP drops the datagrams that don't come from the client of the session, as a
+// UDP socket accepts datagrams from anyone. Each rejected source is only logged once. The source
+// of the first datagram relayed is the peer of the connection
+type sourceCheckedUDP struct {
+	*net.UDPConn
+	media    *mediaGroup
+	kind     string
+	rejected map[string]bool
+
+	stats      *MediaConnection
+	identified bool
+}
+
+func (c *sourceCheckedUDP) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFromUDP(b)
+		if err != nil {
+			return n, err
+		}
+		if c.media.allows(addr) {
+			if !c.identified {
+				c.identified = true
+				c.media.identify(c.stats, addr)
+			}
+			return n, err
+		}
+
+		if !c.rejected[addr.String()] {
+			c.rejected[addr.String()] = true
+			c.media.logRejected(c.kind, addr)
+		}
+	}
+}
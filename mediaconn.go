@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MediaInitiator is the peer that opened a media connection
+type MediaInitiator string
+
+const (
+	// InitiatorClient is when the connection comes from the IP of the client of the session
+	InitiatorClient MediaInitiator = "client"
+
+	// InitiatorUpstream is when the connection comes from the IP of the server of the session
+	InitiatorUpstream MediaInitiator = "upstream"
+
+	// InitiatorUnknown is when the connection comes from neither
+	InitiatorUnknown MediaInitiator = "unknown"
+)
+
+// MediaConnection describes a media connection of a session, for the session summary
+type MediaConnection struct {
+	// Kind is the media kind (VIDEO, AUDIO, CONTROL or KNOCK)
+	Kind string
+
+	// Remote is the address of the peer that opened the connection. For UDP, it's the source
+	// of the first datagram, and it's empty until one is received
+	Remote string
+
+	// Initiator is which peer of the session Remote is
+	Initiator MediaInitiator
+
+	// Started and Ended are when the relay started and ended. Ended is zero while it runs
+	Started time.Time
+	Ended   time.Time
+
+	// RequestBytes and ResponseBytes count the bytes relayed toward the server and the client
+	RequestBytes  atomic.Int64
+	ResponseBytes atomic.Int64
+}
+
+// Describe returns a single line with the kind, initiator, duration and bytes of the connection
+func (c *MediaConnection) Describe() string {
+	ended := c.Ended
+	if ended.IsZero() {
+		ended = time.Now()
+	}
+
+	remote := c.Remote
+	if remote == "" {
+		remote = "no peer"
+	}
+
+	return fmt.Sprintf("%s from %s (%s) for %v, request=%d response=%d bytes", c.Kind, remote, c.Initiator, ended.Sub(c.Started).Round(time.Millisecond), c.RequestBytes.Load(), c.ResponseBytes.Load())
+}
+
+// initiator returns which peer of the session a media connection from addr comes from. When the
+// client and the server share an IP, the connection is taken as the client's, as it's the one
+// expected to connect. Clients on a unix socket have no IP to compare, so they are assumed
+func (g *mediaGroup) initiator(addr net.Addr) MediaInitiator {
+	ip := clientIP(addr)
+	switch {
+	case ip == g.client || net.ParseIP(g.client) == nil:
+		return InitiatorClient
+	case ip == g.upstream:
+		return InitiatorUpstream
+	default:
+		return InitiatorUnknown
+	}
+}
+
+// connection adds a media connection to the group, from addr if it's known yet
+func (g *mediaGroup) connection(kind string, addr net.Addr) *MediaConnection {
+	conn := &MediaConnection{Kind: kind, Started: time.Now()}
+	if addr != nil {
+		conn.Remote = addr.String()
+		conn.Initiator = g.initiator(addr)
+	}
+
+	g.mu.Lock()
+	g.connections = append(g.connections, conn)
+	g.mu.Unlock()
+
+	return conn
+}
+
+// identify sets the peer of a UDP media connection from its first datagram, and reports it if
+// it isn't the client
+func (g *mediaGroup) identify(conn *MediaConnection, addr net.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if conn.Remote != "" {
+		return
+	}
+	conn.Remote = addr.String()
+	conn.Initiator = g.initiator(addr)
+
+	if conn.Initiator != InitiatorClient {
+		log.Printf("[ANOMALY] %s datagrams of session %d come from %s (%s), not from the client %s\n", conn.Kind, g.session, addr, conn.Initiator, g.client)
+	}
+}
+
+// end marks a media connection as ended
+func (g *mediaGroup) end(conn *MediaConnection) {
+	g.mu.Lock()
+	conn.Ended = time.Now()
+	g.mu.Unlock()
+}
+
+// describeConnections returns a line for each media connection of the session, in the order
+// they were opened
+func (g *mediaGroup) describeConnections() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.connections) == 0 {
+		return "none"
+	}
+
+	lines := make([]string, len(g.connections))
+	for i, conn := range g.connections {
+		lines[i] = conn.Describe()
+	}
+
+	return "\n\t" + strings.Join(lines, "\n\t")
+}
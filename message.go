@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // Message represents an iRTSP message. iRTSP (possibly standing for Interactive RTSP?) is a
@@ -34,106 +40,594 @@ type Message struct {
 	// Method is the message method
 	Method string
 
-	// Code is the response code, if the message is a response
+	// Type is whether the message is a request or a response
+	Type MessageType
+
+	// Code is the response code, if the message is a response. It can be zero
 	Code int
 
-	// Headers are the message headers
-	Headers map[string]string
+	// Headers are the message headers, in the order they were received
+	Headers Headers
+
+	// Body is what comes after the headers and before the Submit line, as received, with its
+	// line endings. It's nil if the message has none, which is the common case. Where it starts
+	// is set by bodyDelimiter
+	Body []byte
+
+	// LineEndings are the line endings of each line as received. The last one is empty if
+	// the message didn't end with a line ending. It's nil if they were all CRLF
+	LineEndings []string
+
+	// Raw is the message as it was received. It's nil if the message wasn't parsed
+	Raw []byte
+
+	// Complete is whether the message ended with the Submit terminator. NewMessage only returns
+	// complete messages, an incomplete one being parsed with ParseOptions.AllowIncomplete. It's
+	// serialized without the terminator, so that one the peer never sent isn't added
+	Complete bool
+
+	// Direction is the side that sent the message, "CLIENT" or "SERVER", and Timestamp when its
+	// last byte was read. They are only set on the messages read by the proxy
+	Direction string
+	Timestamp time.Time
 }
 
-// ToBytes converts the message to a byte stream
+// VideoTransport returns the transport of the video stream, and whether the message has a valid one
+func (m *Message) VideoTransport() (TransportInfo, bool) {
+	return m.transport(HeaderVideo)
+}
+
+// AudioTransport returns the transport of the audio stream, and whether the message has a valid one
+func (m *Message) AudioTransport() (TransportInfo, bool) {
+	return m.transport(HeaderAudio)
+}
+
+// ControlTransport returns the transport of the control stream, and whether the message has a valid one
+func (m *Message) ControlTransport() (TransportInfo, bool) {
+	return m.transport(HeaderControl)
+}
+
+// KnockTransport returns the transport of the KNOCK connection, and whether the message has a valid one
+func (m *Message) KnockTransport() (TransportInfo, bool) {
+	return m.transport(HeaderKnockPort)
+}
+
+// Tick returns the "t" header as a duration, and whether the message has a valid one. It's
+// believed to be a tick of the client in milliseconds, from an unknown epoch, so it's not a time
+// yet. A missing, non-numeric or negative value isn't valid
+func (m *Message) Tick() (time.Duration, bool) {
+	value, ok := m.Headers.Lookup(HeaderTime)
+	if !ok {
+		return 0, false
+	}
+
+	ticks, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ticks < 0 || ticks > math.MaxInt64/int64(time.Millisecond) {
+		return 0, false
+	}
+
+	return time.Duration(ticks) * time.Millisecond, true
+}
+
+// SetTick sets the "t" header to a duration, formatted as Tick parses it, in whole milliseconds
+func (m *Message) SetTick(tick time.Duration) {
+	m.Headers.Set(HeaderTime, strconv.FormatInt(tick.Milliseconds(), 10))
+}
+
+// transport parses the first value of a transport header
+func (m *Message) transport(header string) (TransportInfo, bool) {
+	value, ok := m.Headers.Lookup(header)
+	if !ok {
+		return TransportInfo{}, false
+	}
+
+	transport, err := ParseTransport(value)
+	return transport, err == nil
+}
+
+// HeaderSplit determines how a header line is split into its key and value
+type HeaderSplit int
+
+const (
+	// SplitFirst splits header lines on the first equal sign
+	SplitFirst HeaderSplit = iota
+
+	// SplitLast splits header lines on the last equal sign, for keys that contain one
+	SplitLast
+)
+
+// defaultMaxHeaders is the number of header lines above which a message is rejected, if
+// PONSE_MAX_HEADERS isn't set. Real messages have a handful, but short lines can fit tens of
+// thousands of them under the size limit, each one allocated when parsed
+const defaultMaxHeaders = 256
+
+// headerSplit is the HeaderSplit used when parsing messages
+var headerSplit = SplitFirst
+
+// ToBytes converts the message to a byte stream. A parsed message that wasn't modified is
+// returned exactly as it was received, even if parsing lost something, so that the proxy
+// forwards what it doesn't rewrite untouched. Other messages use canonical CRLF line endings
 func (m *Message) ToBytes() []byte {
-	builder := &strings.Builder{}
+	if m.Raw != nil && !m.Modified() {
+		return m.Raw
+	}
+
+	return m.Serialize(false)
+}
+
+// Clone returns a deep copy of the message, which can be changed without affecting the original
+func (m *Message) Clone() *Message {
+	clone := *m
+	clone.Headers = m.Headers.Clone()
+	clone.LineEndings = slices.Clone(m.LineEndings)
+	clone.Body = bytes.Clone(m.Body)
+	clone.Raw = bytes.Clone(m.Raw)
+	return &clone
+}
+
+// MessageType is whether a message is a request or a response. Either side can send both
+type MessageType int
+
+const (
+	// MessageRequest is a message with a "SET/<method>" line
+	MessageRequest MessageType = iota
+
+	// MessageResponse is a message with a "RSP/<method>/<code>" line
+	MessageResponse
+)
 
-	builder.WriteString(m.Version + "\r\n")
-	builder.WriteString(fmt.Sprintf("Seq=%d\r\n", m.Sequence))
+func (t MessageType) String() string {
+	if t == MessageResponse {
+		return "response"
+	}
+
+	return "request"
+}
 
-	// If the code isn't zero, then the message is a response and we can use the response line
-	if m.Code > 0 {
-		builder.WriteString(fmt.Sprintf("RSP/%s/%d\r\n", m.Method, m.Code))
+// IsResponse returns whether the message is a response, as told by its method line
+func (m *Message) IsResponse() bool {
+	return m.Type == MessageResponse
+}
+
+// String returns the message in a single line for logs, like "REQ SET/START seq=3 sc t=1429051"
+// for a request or "RSP START/200 seq=3 v=iDataChunk/unicast/tcp/40603" for a response
+func (m *Message) String() string {
+	b := make([]byte, 0, m.EncodedLen())
+	if m.IsResponse() {
+		b = append(append(append(b, "RSP "...), m.Method...), '/')
+		b = strconv.AppendInt(b, int64(m.Code), 10)
 	} else {
-		builder.WriteString(fmt.Sprintf("SET/%s\r\n", m.Method))
+		b = append(append(b, "REQ SET/"...), m.Method...)
 	}
+	b = strconv.AppendInt(append(b, " seq="...), int64(m.Sequence), 10)
 
-	for header, value := range m.Headers {
-		// If a header value is empty, we don't write the equal sign
-		if value == "" {
-			builder.WriteString(header + "\r\n")
+	for _, field := range m.Headers.Fields() {
+		b = field.appendTo(append(b, ' '))
+	}
+
+	return string(b)
+}
+
+// Verbose returns the message as it's written on the wire, with each line indented and without
+// the line endings, for logs. A body, which can be binary, is shown as its size and first bytes
+func (m *Message) Verbose() string {
+	wire := m.ToBytes()
+	if end := bytes.LastIndex(wire, []byte("Submit")); m.Body != nil && end >= 0 {
+		if start := bytes.LastIndex(wire[:end], m.Body); start >= 0 {
+			summary := fmt.Sprintf("<body of %d bytes: %s>\n", len(m.Body), bodyPreview(m.Body))
+			wire = append(append(bytes.Clone(wire[:start]), summary...), wire[end:]...)
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(string(wire), "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "    " + strings.TrimSuffix(line, "\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Modified returns whether the headers were changed since the message was parsed. The other
+// fields are never rewritten by the proxy
+func (m *Message) Modified() bool {
+	return m.Headers.modified
+}
+
+// WriteTo writes the message to w in a single write, like ToBytes returns it, without building
+// intermediate strings. It implements io.WriterTo
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	data := m.Raw
+	if data == nil || m.Modified() {
+		data = m.appendTo(make([]byte, 0, m.EncodedLen()), false)
+	}
+
+	n, err := writeFull(w, data)
+	return int64(n), err
+}
+
+// Serialize converts the message to a byte stream. If preserveEndings is set, each line keeps
+// the line ending it was received with, so that an unchanged message is reproduced byte for
+// byte. This only applies while the message has the same lines it was parsed with, as
+// otherwise there is no way to tell which ending belongs to which line, and CRLF is used
+func (m *Message) Serialize(preserveEndings bool) []byte {
+	return m.appendTo(make([]byte, 0, m.EncodedLen()), preserveEndings)
+}
+
+// appendTo appends the lines of the message to b, with the line endings as in Serialize
+func (m *Message) appendTo(b []byte, preserveEndings bool) []byte {
+	// The version, sequence, method and Submit lines, a line per header, and the empty line
+	// before the body. The lines of the body aren't counted, as it's written as received
+	lineCount := 3 + m.Headers.Len()
+	if m.Complete {
+		lineCount++
+	}
+	if m.Body != nil && bodyDelimiter == BodyAfterBlankLine {
+		lineCount++
+	}
+	endings := m.LineEndings
+	if !preserveEndings || len(endings) != lineCount {
+		endings = nil
+	}
+
+	line := 0
+	endLine := func(b []byte) []byte {
+		ending := "\r\n"
+		if endings != nil {
+			ending = endings[line]
+		}
+		line++
+		return append(b, ending...)
+	}
+
+	b = endLine(append(b, m.Version...))
+	b = endLine(strconv.AppendInt(append(b, "Seq="...), int64(m.Sequence), 10))
+
+	if m.IsResponse() {
+		b = append(append(append(b, "RSP/"...), m.Method...), '/')
+		b = strconv.AppendInt(b, int64(m.Code), 10)
+	} else {
+		b = append(append(b, "SET/"...), m.Method...)
+	}
+	b = endLine(b)
+
+	// Headers that weren't changed are written exactly as received, as the split between
+	// key and value can be ambiguous
+	for _, field := range m.Headers.Fields() {
+		if field.Raw != "" {
+			b = append(b, field.Raw...)
 		} else {
-			builder.WriteString(fmt.Sprintf("%s=%s\r\n", header, value))
+			b = field.appendTo(b)
+		}
+		b = endLine(b)
+	}
+
+	if m.Body != nil {
+		if bodyDelimiter == BodyAfterBlankLine {
+			b = endLine(b)
+		}
+		b = append(b, m.Body...)
+
+		// A body set without a final line ending still needs one before the Submit line
+		if m.Complete && len(m.Body) > 0 && m.Body[len(m.Body)-1] != '\n' {
+			b = append(b, "\r\n"...)
 		}
 	}
-	builder.WriteString("Submit\r\n")
 
-	return []byte(builder.String())
+	if !m.Complete {
+		return b
+	}
+
+	return endLine(append(b, "Submit"...))
 }
 
-// NewMessage creates a new Message from a byte array
-//
-// TODO: Support multiple messages on the same stream
-func NewMessage(message []byte) *Message {
-	messageString := string(message)
-	// Replace CRLF line endings with LF so that we can split the message lines
-	messageString = strings.ReplaceAll(messageString, "\r\n", "\n")
-	messageLines := strings.Split(messageString, "\n")
-	if len(messageLines) <= 0 {
-		return nil
+// EncodedLen returns the length of the message as Serialize writes it with CRLF line endings,
+// which is also the length of ToBytes for a message that was modified or not parsed. Line
+// endings preserved from the received message can only make it shorter
+func (m *Message) EncodedLen() int {
+	// The version, sequence and method lines. The numbers are formatted into a scratch buffer
+	// to count their digits
+	var scratch [20]byte
+	n := len(m.Version) + 2
+	n += len("Seq=") + len(strconv.AppendInt(scratch[:0], int64(m.Sequence), 10)) + 2
+	if m.IsResponse() {
+		n += len("RSP/") + len(m.Method) + 1 + len(strconv.AppendInt(scratch[:0], int64(m.Code), 10)) + 2
+	} else {
+		n += len("SET/") + len(m.Method) + 2
 	}
 
-	// As there is a CRLF at the end, the last line will be empty
-	messageLines = messageLines[:len(messageLines)-1]
-	if messageLines[len(messageLines)-1] == "Submit" {
-		// Remove "Submit" line
-		messageLines = messageLines[:len(messageLines)-1]
+	// Line endings in keys and values are written as spaces, so the fields keep their length
+	for _, field := range m.Headers.Fields() {
+		switch {
+		case field.Raw != "":
+			n += len(field.Raw)
+		case field.HasValue:
+			n += len(field.Key) + 1 + len(field.Value)
+		default:
+			n += len(field.Key)
+		}
+		n += 2
 	}
 
-	msg := &Message{Headers: make(map[string]string)}
-	msg.Version = messageLines[0]
+	if m.Body != nil {
+		if bodyDelimiter == BodyAfterBlankLine {
+			n += 2
+		}
+		n += len(m.Body)
+		if m.Complete && len(m.Body) > 0 && m.Body[len(m.Body)-1] != '\n' {
+			n += 2
+		}
+	}
 
-	// Discard the vresion line
-	messageLines = messageLines[1:]
+	if !m.Complete {
+		return n
+	}
 
-	// Extract sequence value from message lines
-	seqField, seqValue, found := strings.Cut(messageLines[0], "=")
+	return n + len("Submit\r\n")
+}
+
+// splitHeader splits a header line into its key and value following headerSplit. The line
+// is ambiguous if it has more than one equal sign, as then the key could contain one too
+func splitHeader(line string) (string, string, bool) {
+	ambiguous := strings.Count(line, "=") > 1
+	if headerSplit == SplitLast {
+		if i := strings.LastIndex(line, "="); i >= 0 {
+			return line[:i], line[i+1:], ambiguous
+		}
+		return line, "", ambiguous
+	}
+
+	key, value, _ := strings.Cut(line, "=")
+	return key, value, ambiguous
+}
+
+// ParseOptions are the options of ParseMessage
+type ParseOptions struct {
+	// Strict rejects messages that are out of the spec but can still be parsed: without the
+	// Seq line, with a version revision that isn't two numbers, with control characters in a
+	// header line, or with spaces around a header key or value. The proxy parses leniently, to
+	// forward what it can, and reports these as anomalies at most
+	Strict bool
+
+	// AllowIncomplete parses a message without the Submit terminator, like the end of a capture
+	// that was cut short, instead of rejecting it. The message has Complete unset
+	AllowIncomplete bool
+
+	// KeepSpaces keeps the spaces and tabs around header keys and values when parsing
+	// leniently, so that " t =1" has the key " t ". They are trimmed by default, so that lookups
+	// find the header. The line is still forwarded as received while it isn't changed
+	KeepSpaces bool
+}
+
+// headerSpaces are the characters trimmed around header keys and values
+const headerSpaces = " \t"
+
+// NewMessage creates a new Message from a byte array, parsing it leniently. It returns an error
+// if the bytes aren't a whole message: empty, without the version line, with an invalid sequence,
+// method line or response code, or without the Submit terminator, like when a message was
+// truncated. Use a MessageReader to split a stream into messages
+func NewMessage(message []byte) (*Message, error) {
+	return ParseMessage(message, ParseOptions{})
+}
+
+// lineCursor walks over the lines of a message. The lines are returned as offsets, so that they
+// can be read from the bytes of the message or taken from a single string of it, without copies
+type lineCursor struct {
+	data []byte
+
+	// text holds the same bytes as data, to take lines as strings. It's only set when needed
+	text string
+
+	// pos is the offset of the next line
+	pos int
+}
+
+// next returns the offsets of the next line, without its line ending, and the line ending:
+// "\r\n", "\n", or "" for a last line without one. ok is false once every line was returned
+func (c *lineCursor) next() (start, end int, ending string, ok bool) {
+	if c.pos >= len(c.data) {
+		return 0, 0, "", false
+	}
+
+	start = c.pos
+	i := bytes.IndexByte(c.data[start:], '\n')
+	if i < 0 {
+		c.pos = len(c.data)
+		return start, len(c.data), "", true
+	}
+
+	end = start + i
+	c.pos = end + 1
+	if end > start && c.data[end-1] == '\r' {
+		return start, end - 1, "\r\n", true
+	}
+
+	return start, end, "\n", true
+}
+
+// nextLine returns the next line as a string, and whether there is one
+func (c *lineCursor) nextLine() (string, bool) {
+	start, end, _, ok := c.next()
+	return c.text[start:end], ok
+}
+
+// isNotCRLF returns whether a line ending isn't CRLF
+func isNotCRLF(ending string) bool {
+	return ending != "\r\n"
+}
+
+// ParseMessage creates a new Message from a byte array like NewMessage, with the given options.
+// The bytes are only copied twice, to the raw message and to a string the version, method and
+// header keys and values are taken from, as the proxy parses every message it forwards
+func ParseMessage(message []byte, options ParseOptions) (*Message, error) {
+	if len(message) > maxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, len(message), maxMessageSize)
+	}
+
+	// A first pass checks the size of the lines and finds the Submit line, which must be the last
+	lines := lineCursor{data: message}
+	lineCount, submitStart, crlf := 0, 0, true
+	var lastLine []byte
+	for start, end, ending, ok := lines.next(); ok; start, end, ending, ok = lines.next() {
+		if end-start > maxLineSize {
+			return nil, fmt.Errorf("%w: line of %d bytes, the limit is %d", ErrMessageTooLarge, end-start, maxLineSize)
+		}
+		lineCount++
+		submitStart, lastLine = start, message[start:end]
+		crlf = crlf && ending == "\r\n"
+	}
+	if lineCount == 0 {
+		return nil, errors.New("empty message")
+	}
+	complete := bytes.Equal(lastLine, submitLine)
+	if !complete {
+		if !options.AllowIncomplete {
+			return nil, errors.New("missing Submit terminator")
+		}
+		submitStart = len(message)
+	}
+
+	msg := &Message{Raw: bytes.Clone(message), Complete: complete}
+
+	// Keep the line endings, as some peers use LF only or even mix both. They are left out when
+	// the lines outside the body all end with CRLF, which is how the message is serialized
+	// without them anyway
+	if !crlf {
+		msg.LineEndings = make([]string, 0, lineCount)
+		lines = lineCursor{data: message}
+		for _, _, ending, ok := lines.next(); ok; _, _, ending, ok = lines.next() {
+			msg.LineEndings = append(msg.LineEndings, ending)
+		}
+	}
+
+	// The other passes only go over the lines before the Submit line
+	lines = lineCursor{data: message[:submitStart], text: string(message[:submitStart])}
+	line, ok := lines.nextLine()
+	if !ok || !strings.HasPrefix(line, "iRTSP/") {
+		return nil, errors.New("missing version line")
+	}
+	msg.Version = line
+
+	// The version is kept as received even if its revision can't be parsed, so that a peer
+	// speaking an unexpected revision is still proxied. Problems reports it
+	if options.Strict {
+		if _, err := ParseVersion(msg.Version); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrOutOfSpec, err)
+		}
+	}
+
+	// The lines before the headers, to find the line endings of the body
+	headerLine := 1
+
+	line, ok = lines.nextLine()
+	if !ok {
+		return nil, errors.New("missing method line")
+	}
+
+	// Extract the sequence value
+	seqField, seqValue, found := strings.Cut(line, "=")
 	if found && seqField == "Seq" {
 		seq, err := strconv.Atoi(seqValue)
 		if err != nil {
-			log.Printf("[ERROR] %v\n", err)
-			return msg
+			return nil, fmt.Errorf("invalid Seq %q: %w", seqValue, err)
 		}
 
 		msg.Sequence = seq
-		messageLines = messageLines[1:]
+		headerLine++
+		line, ok = lines.nextLine()
+		if !ok {
+			return nil, errors.New("missing method line")
+		}
+	} else if options.Strict {
+		return nil, fmt.Errorf("%w: missing Seq line", ErrOutOfSpec)
 	}
 
-	// Extract method from message lines
-	msgSource, msgMethod, found := strings.Cut(messageLines[0], "/")
-	// If the message is a request, we can set the method right away
-	if found && msgSource == "SET" {
+	// Extract the method. The line is either "SET/<method>" for a request or
+	// "RSP/<method>/<code>" for a response
+	msgSource, msgMethod, _ := strings.Cut(line, "/")
+	switch msgSource {
+	case "SET":
 		msg.Method = msgMethod
-		messageLines = messageLines[1:]
-	}
 
-	// If the message is a response, we have to split the method and the response code
-	if found && msgSource == "RSP" {
+	case "RSP":
+		// If the message is a response, we have to split the method and the response code
 		method, codeString, found := strings.Cut(msgMethod, "/")
-		if found {
-			msg.Method = method
-			code, err := strconv.Atoi(codeString)
-			if err != nil {
-				log.Printf("[ERROR] %v\n", err)
-				return msg
+		if !found {
+			return nil, fmt.Errorf("missing response code in %q", line)
+		}
+		code, err := strconv.Atoi(codeString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response code %q: %w", codeString, err)
+		}
+		if code < 0 {
+			return nil, fmt.Errorf("invalid response code %q", codeString)
+		}
+
+		msg.Method = method
+		msg.Code = code
+		msg.Type = MessageResponse
+
+	default:
+		return nil, fmt.Errorf("missing method line, found %q", line)
+	}
+	if msg.Method == "" {
+		return nil, fmt.Errorf("empty method in %q", line)
+	}
+	headerLine++
+
+	// The lines left are the headers, then the body if there is one. The body is kept verbatim,
+	// with the line endings of its lines
+	headerStart, headerCount := lines.pos, 0
+	for start, end, _, ok := lines.next(); ok; start, end, _, ok = lines.next() {
+		starts, delimiter := startsBody(message[start:end])
+		if !starts {
+			headerCount++
+			continue
+		}
+
+		bodyStart, bodyLine := start, headerLine+headerCount
+		if delimiter {
+			bodyStart, bodyLine = lines.pos, bodyLine+1
+		}
+		msg.Body = bytes.Clone(message[bodyStart:submitStart])
+		if msg.LineEndings != nil {
+			bodyEnd := lineCount
+			if complete {
+				bodyEnd--
 			}
-			msg.Code = code
+			msg.LineEndings = slices.Delete(msg.LineEndings, bodyLine, bodyEnd)
 		}
-		messageLines = messageLines[1:]
+		break
+	}
+	if msg.LineEndings != nil && !slices.ContainsFunc(msg.LineEndings, isNotCRLF) {
+		msg.LineEndings = nil
+	}
+
+	if headerCount > maxHeaders {
+		return nil, fmt.Errorf("%w: %d header lines, the limit is %d", ErrTooManyHeaders, headerCount, maxHeaders)
+	}
+
+	// Extract the headers
+	lines.pos = headerStart
+	if headerCount > 0 {
+		msg.Headers.fields = make([]HeaderLine, 0, headerCount)
 	}
+	for i := 0; i < headerCount; i++ {
+		msgHeaderField, _ := lines.nextLine()
+		if options.Strict && strings.ContainsFunc(msgHeaderField, unicode.IsControl) {
+			return nil, fmt.Errorf("%w: control character in header line %q", ErrOutOfSpec, msgHeaderField)
+		}
 
-	// Extract headers from message lines
-	for _, msgHeaderField := range messageLines {
-		msgHeader, msgValue, _ := strings.Cut(msgHeaderField, "=")
-		msg.Headers[msgHeader] = msgValue
+		msgHeader, msgValue, ambiguous := splitHeader(msgHeaderField)
+		if trimmedHeader, trimmedValue := strings.Trim(msgHeader, headerSpaces), strings.Trim(msgValue, headerSpaces); trimmedHeader != msgHeader || trimmedValue != msgValue {
+			if options.Strict {
+				return nil, fmt.Errorf("%w: spaces around the key or value of header line %q", ErrOutOfSpec, msgHeaderField)
+			}
+			if !options.KeepSpaces {
+				msgHeader, msgValue = trimmedHeader, trimmedValue
+			}
+		}
+		msg.Headers.add(HeaderLine{Key: msgHeader, Value: msgValue, HasValue: strings.Contains(msgHeaderField, "="), Raw: msgHeaderField, Ambiguous: ambiguous})
 	}
 
-	return msg
+	return msg, nil
 }
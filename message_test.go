@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testMessages are well-formed messages of both sides, used as fixtures and fuzzing seeds
+var testMessages = []string{
+	"iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc=tls\r\nt=1429051\r\nSubmit\r\n",
+	"iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nv=iDataChunk/unicast/tcp/40603\r\na=iDataChunk/unicast/tcp/40603\r\nc=iDataChunk/unicast/tcp/40605\r\nSubmit\r\n",
+	"iRTSP/1.21\r\nSeq=2\r\nRSP/KNOCK/200\r\np=iDataChunk/unicast/tcp/40607;\r\nSubmit\r\n",
+}
+
+func FuzzNewMessage(f *testing.F) {
+	for _, msg := range testMessages {
+		f.Add([]byte(msg))
+	}
+	f.Add([]byte("iRTSP/1.21\nSeq=3\nSET/OPTIONS\nsc\n\nbody line\nSubmit\n"))
+	f.Add([]byte("iRTSP/1.21\r\nSeq=4\r\nSET/SETUP\r\n t = 1 \r\nk=v=w\r\nSubmit\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := NewMessage(data)
+		if err != nil {
+			return
+		}
+
+		for _, preserveEndings := range []bool{true, false} {
+			serialized := msg.Serialize(preserveEndings)
+			again, err := NewMessage(serialized)
+			if err != nil {
+				t.Fatalf("Serialize(%v) of %q = %q, which doesn't parse: %v", preserveEndings, data, serialized, err)
+			}
+			if again.Type != msg.Type || again.Method != msg.Method || again.Sequence != msg.Sequence {
+				t.Fatalf("Serialize(%v) of %q parses as %s, want %s", preserveEndings, data, again, msg)
+			}
+		}
+	})
+}
+
+func TestNewMessageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		strict bool
+		err    string
+	}{
+		{"no version line", "Seq=1\r\nSET/START\r\nSubmit\r\n", false, "missing version line"},
+		{"bare Submit", "Submit\r\n", false, "missing version line"},
+		{"missing Seq, strict", "iRTSP/1.21\r\nSET/START\r\nSubmit\r\n", true, "message out of spec: missing Seq line"},
+		{"missing method after Seq", "iRTSP/1.21\r\nSeq=1\r\nSubmit\r\n", false, "missing method line"},
+		{"missing method and Seq", "iRTSP/1.21\r\nSubmit\r\n", false, "missing method line"},
+		{"header instead of method", "iRTSP/1.21\r\nSeq=1\r\nt=1\r\nSubmit\r\n", false, `missing method line, found "t=1"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseMessage([]byte(test.raw), ParseOptions{Strict: test.strict})
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("ParseMessage(%q) error = %v, want %q", test.raw, err, test.err)
+			}
+		})
+	}
+}
+
+func TestNewMessageWithoutSeq(t *testing.T) {
+	raw := []byte("iRTSP/1.21\r\nSET/START\r\nSubmit\r\n")
+
+	msg, err := NewMessage(raw)
+	if err != nil {
+		t.Fatalf("NewMessage(%q) error = %v, want the message parsed leniently", raw, err)
+	}
+	if msg.Sequence != 0 || msg.Method != "START" {
+		t.Errorf("NewMessage(%q) = %s, want a START request with Seq 0", raw, msg)
+	}
+
+	if _, err := ParseMessage(raw, ParseOptions{Strict: true}); !errors.Is(err, ErrOutOfSpec) {
+		t.Errorf("strict ParseMessage(%q) error = %v, want ErrOutOfSpec", raw, err)
+	}
+}
+
+func BenchmarkNewMessage(b *testing.B) {
+	messages := make([][]byte, len(testMessages))
+	for i, msg := range testMessages {
+		messages[i] = []byte(msg)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range messages {
+			if _, err := NewMessage(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkResponse returns a SETUP response with ten headers, as the proxy forwards it after
+// changing a header, so that it's serialized instead of written from its raw bytes
+func benchmarkResponse(b *testing.B) *Message {
+	raw := "iRTSP/1.21\r\nSeq=3\r\nRSP/SETUP/200\r\n"
+	for i := 0; i < 10; i++ {
+		raw += "h" + strconv.Itoa(i) + "=iDataChunk/unicast/tcp/4060" + strconv.Itoa(i) + "\r\n"
+	}
+	msg, err := NewMessage([]byte(raw + "Submit\r\n"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg.Headers.Set("h0", "iDataChunk/unicast/tcp/40610")
+
+	return msg
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	msg := benchmarkResponse(b)
+
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := msg.WriteTo(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ToBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := writeFull(io.Discard, msg.ToBytes()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkToBytes(b *testing.B) {
+	msg := benchmarkResponse(b)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg.ToBytes()
+	}
+}
+
+func TestEncodedLen(t *testing.T) {
+	parse := func(raw string) *Message {
+		msg, err := NewMessage([]byte(raw))
+		if err != nil {
+			t.Fatalf("NewMessage(%q) error = %v", raw, err)
+		}
+		return msg
+	}
+
+	modified := parse(testMessages[1])
+	modified.Headers.Set("v", "iDataChunk/unicast/tcp/40613")
+	modified.Headers.Add("x", "1")
+
+	modifiedBody := parse("iRTSP/1.21\r\nSeq=5\r\nSET/OPTIONS\r\nt=1\r\n\r\nline 1\r\nSubmit\r\n")
+	modifiedBody.Headers.Set("t", "20")
+
+	withoutFinalNewline := NewRequest(MethodStart, Header{Key: HeaderScheme, Bare: true})
+	withoutFinalNewline.Body = []byte("payload")
+
+	emptyBody := NewResponse(MethodSetup, 200)
+	emptyBody.Body = []byte{}
+
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"raw request", parse(testMessages[0])},
+		{"raw response", parse(testMessages[1])},
+		{"raw bare header", parse(testMessages[2])},
+		{"modified", modified},
+		{"raw body", parse("iRTSP/1.21\r\nSeq=5\r\nSET/OPTIONS\r\nt=1\r\n\r\nline 1\r\nline 2\r\nSubmit\r\n")},
+		{"modified body", modifiedBody},
+		{"body without final newline", withoutFinalNewline},
+		{"empty body", emptyBody},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, want := test.msg.EncodedLen(), len(test.msg.ToBytes()); got != want {
+				t.Errorf("EncodedLen() = %d, want len(ToBytes()) = %d for %q", got, want, test.msg.ToBytes())
+			}
+		})
+	}
+}
+
+func TestNewMessageInvalidInput(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{"empty", "", "empty message"},
+		{"truncated before Submit", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\n", "missing Submit terminator"},
+		{"truncated in Submit", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nSub", "missing Submit terminator"},
+		{"invalid Seq", "iRTSP/1.21\r\nSeq=abc\r\nSET/START\r\nSubmit\r\n", `invalid Seq "abc": strconv.Atoi: parsing "abc": invalid syntax`},
+		{"invalid code", "iRTSP/1.21\r\nSeq=1\r\nRSP/START/ok\r\nSubmit\r\n", `invalid response code "ok": strconv.Atoi: parsing "ok": invalid syntax`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := NewMessage([]byte(test.raw))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("NewMessage(%q) error = %v, want %q", test.raw, err, test.err)
+			}
+			if msg != nil {
+				t.Errorf("NewMessage(%q) = %s, want nil with the error", test.raw, msg)
+			}
+		})
+	}
+}
+
+func TestNewMessageTruncated(t *testing.T) {
+	// Every prefix of a message up to its Submit line is rejected, wherever the stream was cut
+	raw := testMessages[0]
+	complete := len(raw) - len("\r\n")
+	for i := 0; i < complete; i++ {
+		if msg, err := NewMessage([]byte(raw[:i])); err == nil {
+			t.Errorf("NewMessage(%q) = %s, want an error", raw[:i], msg)
+		}
+	}
+
+	// A last Submit line without its line ending still completes the message
+	if _, err := NewMessage([]byte(raw[:complete])); err != nil {
+		t.Errorf("NewMessage(%q) error = %v, want the message", raw[:complete], err)
+	}
+}
+
+func TestIncompleteMessage(t *testing.T) {
+	for _, raw := range testMessages {
+		msg, err := NewMessage([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Complete {
+			t.Errorf("NewMessage(%q).Complete = false", raw)
+		}
+	}
+	if !NewRequest(MethodOptions).Complete {
+		t.Error("NewRequest().Complete = false")
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"cut before Submit", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\n"},
+		{"cut in a header line", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=14"},
+		{"cut in the body", "iRTSP/1.21\nSeq=5\nSET/OPTIONS\nt=1\n\nline 1\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := ParseMessage([]byte(test.raw), ParseOptions{AllowIncomplete: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Complete {
+				t.Error("Complete = true without the Submit line")
+			}
+
+			// The terminator the peer never sent isn't added
+			if got := string(msg.Serialize(true)); got != test.raw {
+				t.Errorf("Serialize(true) = %q, want %q", got, test.raw)
+			}
+			serialized := msg.Serialize(false)
+			if bytes.Contains(serialized, []byte("Submit")) {
+				t.Errorf("Serialize(false) = %q, want no Submit line", serialized)
+			}
+			if got := msg.EncodedLen(); got != len(serialized) {
+				t.Errorf("EncodedLen() = %d, want %d", got, len(serialized))
+			}
+
+			data, err := msg.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var again Message
+			if err := again.UnmarshalJSON(data); err != nil {
+				t.Fatal(err)
+			}
+			if again.Complete || !bytes.Equal(again.ToBytes(), msg.ToBytes()) {
+				t.Errorf("JSON round trip = %q (complete=%v), want %q", again.ToBytes(), again.Complete, msg.ToBytes())
+			}
+		})
+	}
+}
+
+func TestCloneIsolation(t *testing.T) {
+	raw := "iRTSP/1.21\nSeq=0\nSET/START\nsc=tls\nt=1429051\n\nbody\nSubmit\n"
+	original, err := NewMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := original.Verbose()
+
+	clone := original.Clone()
+	if err := clone.SetScheme(SchemeNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.Headers.Add("x", "1"); err != nil {
+		t.Fatal(err)
+	}
+	clone.Headers.Del("t")
+	clone.Body[0] = 'B'
+	clone.Raw[0] = 'X'
+	clone.LineEndings[0] = "\r\n"
+
+	if got := original.Verbose(); got != before {
+		t.Errorf("original after changing the clone = %s, want %s", got, before)
+	}
+	if original.Modified() {
+		t.Error("original is modified after changing the clone")
+	}
+	if got := string(original.ToBytes()); got != raw {
+		t.Errorf("original ToBytes() = %q, want %q", got, raw)
+	}
+	if original.Scheme() != SchemeTLS || original.Headers.Get("t") != "1429051" || string(original.Body) != "body\n" {
+		t.Errorf("original = %s with body %q, want sc=tls, t=1429051 and body %q", original, original.Body, "body\n")
+	}
+	if original.LineEndings[0] != "\n" {
+		t.Errorf("original line ending = %q, want LF", original.LineEndings[0])
+	}
+}
+
+func TestCloneIsolationIndexed(t *testing.T) {
+	original := manyHeaders(t)
+	clone := original.Clone()
+	clone.Headers.Del("h0")
+	if err := clone.Headers.Set("h1", "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := original.Headers.Get("h0"); got != "0" {
+		t.Errorf("original Get(h0) = %q, want 0", got)
+	}
+	if got := original.Headers.Get("h1"); got != "1" {
+		t.Errorf("original Get(h1) = %q, want 1", got)
+	}
+	if got := clone.Headers.Get("h2"); got != "2" {
+		t.Errorf("clone Get(h2) = %q, want 2", got)
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+
+		// lenient and strict are the errors of each mode, empty if the message is parsed
+		lenient string
+		strict  string
+	}{
+		{"valid", testMessages[0], "", ""},
+		{"missing Seq", "iRTSP/1.21\r\nSET/START\r\nSubmit\r\n", "", "message out of spec: missing Seq line"},
+		{"invalid revision", "iRTSP/1.x\r\nSeq=0\r\nSET/START\r\nSubmit\r\n", "", "message out of spec: invalid iRTSP revision \"1.x\": strconv.Atoi: parsing \"x\": invalid syntax"},
+		{"control character", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nt=1\x7f\r\nSubmit\r\n", "", "message out of spec: control character in header line \"t=1\\x7f\""},
+		{"spaces around a header", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\n t =1\r\nSubmit\r\n", "", "message out of spec: spaces around the key or value of header line \" t =1\""},
+		{"unknown method prefix", "iRTSP/1.21\r\nSeq=0\r\nGET/START\r\nSubmit\r\n", "missing method line, found \"GET/START\"", "missing method line, found \"GET/START\""},
+		{"missing Submit", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\n", "missing Submit terminator", "missing Submit terminator"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				options ParseOptions
+				err     string
+			}{
+				{ParseOptions{}, test.lenient},
+				{ParseOptions{Strict: true}, test.strict},
+			} {
+				_, err := ParseMessage([]byte(test.raw), mode.options)
+				if got := fmt.Sprint(err); (mode.err == "" && err != nil) || (mode.err != "" && got != mode.err) {
+					t.Errorf("ParseMessage(%q, %+v) error = %v, want %q", test.raw, mode.options, err, mode.err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	defer func(size, line, headers int) {
+		maxMessageSize, maxLineSize, maxHeaders = size, line, headers
+	}(maxMessageSize, maxLineSize, maxHeaders)
+
+	raw := testMessages[1]
+	longestLine := len("v=iDataChunk/unicast/tcp/40603")
+
+	tests := []struct {
+		name    string
+		size    int
+		line    int
+		headers int
+		err     error
+	}{
+		{"message at the limit", len(raw), longestLine, 3, nil},
+		{"message one byte over", len(raw) - 1, longestLine, 3, ErrMessageTooLarge},
+		{"line one byte over", len(raw), longestLine - 1, 3, ErrMessageTooLarge},
+		{"one header over", len(raw), longestLine, 2, ErrTooManyHeaders},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxMessageSize, maxLineSize, maxHeaders = test.size, test.line, test.headers
+
+			if _, err := NewMessage([]byte(raw)); !errors.Is(err, test.err) {
+				t.Errorf("NewMessage() error = %v, want %v", err, test.err)
+			}
+
+			reader := NewMessageReader(strings.NewReader(raw))
+			if _, err := reader.ReadMessage(); !errors.Is(err, test.err) {
+				t.Errorf("ReadMessage() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"LF", "iRTSP/1.21\nSeq=0\nSET/START\nsc\nt=1\nSubmit\n"},
+		{"mixed", "iRTSP/1.21\r\nSeq=0\nSET/START\r\nsc\nt=1\r\nSubmit\r\n"},
+		{"no final line ending", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1\r\nSubmit"},
+		{"LF with a CRLF body", "iRTSP/1.21\nSeq=0\nSET/START\nt=1\n\nbody\r\nSubmit\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(msg.Serialize(true)); got != test.raw {
+				t.Errorf("Serialize(true) = %q, want %q", got, test.raw)
+			}
+
+			// Canonical serialization uses CRLF outside the body, which is written as received
+			crlf := string(msg.Serialize(false))
+			again, err := NewMessage([]byte(crlf))
+			if err != nil {
+				t.Fatalf("Serialize(false) = %q doesn't parse: %v", crlf, err)
+			}
+			if again.LineEndings != nil || !bytes.Equal(again.Body, msg.Body) {
+				t.Errorf("Serialize(false) = %q, want CRLF line endings and the body kept", crlf)
+			}
+
+			// Changing a header in place keeps the lines, and so their endings
+			if err := msg.Headers.Set("t", "2"); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(msg.Serialize(true)), strings.Replace(test.raw, "t=1", "t=2", 1); got != want {
+				t.Errorf("Serialize(true) after Set(t) = %q, want %q", got, want)
+			}
+
+			// Adding a line leaves no way to match the endings to the lines
+			if err := msg.Headers.Add("x", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(msg.Serialize(true)); got != string(msg.Serialize(false)) {
+				t.Errorf("Serialize(true) after Add = %q, want CRLF line endings", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// jsonMessage is the JSON form of a Message. The headers are an array, so that their order and
+// duplicates are kept
+type jsonMessage struct {
+	Version   string       `json:"version"`
+	Sequence  int          `json:"seq"`
+	Method    string       `json:"method"`
+	Type      string       `json:"type"`
+	Code      int          `json:"code,omitempty"`
+	Headers   []jsonHeader `json:"headers"`
+	Direction string       `json:"direction,omitempty"`
+	Timestamp *time.Time   `json:"timestamp,omitempty"`
+
+	// Body is in base64, and missing if the message has none. An empty body is kept apart, as
+	// it's still preceded by its delimiter
+	Body *[]byte `json:"body,omitempty"`
+
+	// Raw is the wire form of the message, only if the other fields don't reproduce it, like
+	// when the peer didn't use CRLF line endings. It takes precedence over the other fields
+	Raw *string `json:"raw,omitempty"`
+
+	// Incomplete is set for a message without the Submit terminator, so that the usual complete
+	// messages don't need the field
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// jsonHeader is a header field of a jsonMessage. The value is missing for a bare header, like
+// the "sc" flag
+type jsonHeader struct {
+	Name  string  `json:"name"`
+	Value *string `json:"value,omitempty"`
+}
+
+// MarshalJSON converts the message to JSON, in a form that UnmarshalJSON converts back to a
+// message with the same wire form
+func (m *Message) MarshalJSON() ([]byte, error) {
+	msg := jsonMessage{
+		Version:   m.Version,
+		Sequence:  m.Sequence,
+		Method:    m.Method,
+		Type:      m.Type.String(),
+		Code:      m.Code,
+		Headers:   make([]jsonHeader, 0, m.Headers.Len()),
+		Direction: m.Direction,
+
+		Incomplete: !m.Complete,
+	}
+
+	// The headers are serialized from the raw lines they were parsed from, which the JSON form
+	// doesn't hold, like when spaces were trimmed
+	reproduced := true
+	for _, field := range m.Headers.Fields() {
+		reproduced = reproduced && (field.Raw == "" || field.Raw == field.format())
+
+		header := jsonHeader{Name: field.Key}
+		if field.HasValue {
+			value := field.Value
+			header.Value = &value
+		}
+		msg.Headers = append(msg.Headers, header)
+	}
+
+	if !m.Timestamp.IsZero() {
+		msg.Timestamp = &m.Timestamp
+	}
+
+	if m.Body != nil {
+		msg.Body = &m.Body
+	}
+
+	if wire := m.ToBytes(); !reproduced || !bytes.Equal(wire, m.Serialize(false)) {
+		raw := string(wire)
+		msg.Raw = &raw
+	}
+
+	return json.Marshal(msg)
+}
+
+// UnmarshalJSON sets the message from its JSON form, as returned by MarshalJSON
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var msg jsonMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	*m = Message{
+		Version:   msg.Version,
+		Sequence:  msg.Sequence,
+		Method:    msg.Method,
+		Code:      msg.Code,
+		Direction: msg.Direction,
+		Complete:  !msg.Incomplete,
+	}
+
+	switch msg.Type {
+	case MessageRequest.String():
+	case MessageResponse.String():
+		m.Type = MessageResponse
+	default:
+		return fmt.Errorf("invalid message type %q", msg.Type)
+	}
+
+	for _, header := range msg.Headers {
+		field := HeaderLine{Key: header.Name, HasValue: header.Value != nil}
+		if header.Value != nil {
+			field.Value = *header.Value
+		}
+		m.Headers.add(field)
+	}
+
+	if msg.Timestamp != nil {
+		m.Timestamp = *msg.Timestamp
+	}
+
+	if msg.Body != nil {
+		m.Body = *msg.Body
+		if m.Body == nil {
+			m.Body = []byte{}
+		}
+	}
+
+	if msg.Raw != nil {
+		m.Raw = []byte(*msg.Raw)
+	}
+
+	return nil
+}
+
+// jsonLogging returns whether the messages are printed as JSON, one object per line, instead of
+// their wire form, set with the PONSE_LOG_JSON env
+func jsonLogging() bool {
+	return len(os.Getenv("PONSE_LOG_JSON")) > 0
+}
+
+// logMessage logs a message read by the proxy in its wire form, or prints it on stdout as JSON if
+// jsonLogging is set, so that the output can be post-processed
+func logMessage(msg *Message) {
+	if !jsonLogging() {
+		log.Printf("[%s] iRTSP %s:\n%s\n", msg.Direction, msg.Type, msg.Verbose())
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[%s] Failed to marshal %s: %v\n", msg.Direction, msg, err)
+		return
+	}
+
+	fmt.Printf("%s\n", data)
+}
@@ -0,0 +1,48 @@
+package main
+
+// Methods of the iRTSP messages known to the proxy
+const (
+	// MethodOptions is exchanged before the session starts
+	MethodOptions = "OPTIONS"
+
+	// MethodStart starts the session, telling the client whether to upgrade to TLS
+	MethodStart = "START"
+
+	// MethodSetup announces the ports of the media streams
+	MethodSetup = "SETUP"
+
+	// MethodKnock announces the port of the KNOCK connection
+	MethodKnock = "KNOCK"
+)
+
+// MediaAnnouncement is a header of a server message announcing a media connection
+type MediaAnnouncement struct {
+	// Header is the key of the header holding the transport
+	Header string `json:"header"`
+
+	// Kind is the media kind the connection is logged and relayed as
+	Kind string `json:"kind"`
+}
+
+// MethodInfo is how the proxy handles the messages of the server with a method. It's set for
+// each method in protocol.json
+type MethodInfo struct {
+	// Media are the headers announcing media connections, which the proxy starts listening on.
+	// A header can be repeated, and every value is started
+	Media []MediaAnnouncement `json:"media,omitempty"`
+
+	// StartsSession is set for the message telling the scheme of the session with the "sc"
+	// header. The connections are upgraded to TLS after it if the scheme is "tls"
+	StartsSession bool `json:"starts_session,omitempty"`
+
+	// Enters is the protocol state the session enters on the method, empty to leave it unchanged
+	Enters ProtocolState `json:"enters,omitempty"`
+}
+
+// methodInfo returns how the proxy handles a method, as defined in the protocol registry. It's
+// the zero MethodInfo for the methods without a special handling, which are forwarded as they
+// are. The first message of a method the registry doesn't know is logged whole
+func methodInfo(method string) MethodInfo {
+	definition, _ := protocolDefinition(KindMethod, method)
+	return definition.MethodInfo
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types sent to the webhooks
+const (
+	EventSessionError        = "session_error"
+	EventUpstreamUnreachable = "upstream_unreachable"
+	EventCertExpiring        = "cert_expiring"
+	EventBudgetExhausted     = "budget_exhausted"
+	EventTest                = "test"
+)
+
+// notifyRateLimit is the maximum number of notifications sent per minute, so that a storm of
+// errors doesn't flood the receiver. Notifications past the limit are dropped
+const notifyRateLimit = 10
+
+// notifyAttempts is the number of times a notification is sent before giving up
+const notifyAttempts = 3
+
+// Event is the JSON payload posted to the webhooks
+type Event struct {
+	// Type is the event type, like "session_error"
+	Type string `json:"type"`
+
+	// Time is when the event happened
+	Time time.Time `json:"time"`
+
+	// Message describes the event
+	Message string `json:"message"`
+
+	// Upstream is the destination server of the proxy
+	Upstream string `json:"upstream"`
+}
+
+// notifyWindow holds the notifications sent in the current minute for the rate limit
+var notifyWindow struct {
+	sync.Mutex
+	start time.Time
+	count int
+}
+
+// webhookURLs returns the URLs set in the comma-separated PONSE_WEBHOOK_URLS env
+func webhookURLs() []string {
+	var urls []string
+	for _, url := range strings.Split(os.Getenv("PONSE_WEBHOOK_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+// notifyEnabled returns whether an event type is sent. The types can be selected with the
+// comma-separated PONSE_WEBHOOK_EVENTS env, and all of them are sent by default
+func notifyEnabled(eventType string) bool {
+	events := os.Getenv("PONSE_WEBHOOK_EVENTS")
+	if events == "" || eventType == EventTest {
+		return true
+	}
+
+	for _, event := range strings.Split(events, ",") {
+		if strings.TrimSpace(event) == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowNotification counts a notification against the rate limit, and returns whether it can be sent
+func allowNotification() bool {
+	notifyWindow.Lock()
+	defer notifyWindow.Unlock()
+
+	now := time.Now()
+	if now.Sub(notifyWindow.start) >= time.Minute {
+		notifyWindow.start = now
+		notifyWindow.count = 0
+	}
+
+	if notifyWindow.count >= notifyRateLimit {
+		return false
+	}
+
+	notifyWindow.count++
+	return true
+}
+
+// notify sends an event to the webhooks in the background, if any are configured
+func notify(eventType, message string) {
+	urls := webhookURLs()
+	if len(urls) == 0 || !notifyEnabled(eventType) {
+		return
+	}
+
+	if !allowNotification() {
+		log.Printf("[NOTIFY] Rate limit reached, dropping %s event\n", eventType)
+		return
+	}
+
+	event := Event{Type: eventType, Time: time.Now(), Message: message, Upstream: serverControlAddress}
+	for _, url := range urls {
+		go func(url string) {
+			if err := sendEvent(url, event); err != nil {
+				log.Printf("[NOTIFY] %v\n", err)
+			}
+		}(url)
+	}
+}
+
+// sendEvent posts an event to a webhook, retrying with an exponential backoff
+func sendEvent(url string, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = postEvent(client, url, data)
+		if err == nil || attempt == notifyAttempts {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to send %s event to %s after %d attempts: %w", event.Type, url, notifyAttempts, err)
+	}
+
+	return nil
+}
+
+// postEvent makes a single POST of the event payload
+func postEvent(client *http.Client, url string, data []byte) error {
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// notifyTest sends a test event to every webhook and waits for the result, to check the configuration
+func notifyTest() error {
+	urls := webhookURLs()
+	if len(urls) == 0 {
+		return errors.New("PONSE_WEBHOOK_URLS isn't set")
+	}
+
+	event := Event{Type: EventTest, Time: time.Now(), Message: "Test notification from ponse", Upstream: serverControlAddress}
+	var errs []error
+	for _, url := range urls {
+		if err := sendEvent(url, event); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Sent test event to %s\n", url)
+	}
+
+	return errors.Join(errs...)
+}
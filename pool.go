@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// defaultMediaWorkers is the number of relay workers if PONSE_MEDIA_WORKERS isn't set
+const defaultMediaWorkers = 16
+
+// mediaQueueSize is the number of relays that can wait for a free worker before new ones
+// overflow into their own goroutine
+const mediaQueueSize = 64
+
+// mediaPool runs the relays of the short-lived media connections. It's nil until main creates it
+var mediaPool *relayPool
+
+// relayPool runs relays on a bounded set of reusable goroutines. Some titles open and close
+// CONTROL and KNOCK connections hundreds of times per minute, so reusing the goroutines keeps
+// the churn down. When every worker is busy and the queue is full, a relay gets its own
+// goroutine instead of waiting
+type relayPool struct {
+	jobs chan func()
+
+	active     atomic.Int64
+	queued     atomic.Int64
+	overflowed atomic.Int64
+}
+
+// newRelayPool starts a pool with the given number of workers
+func newRelayPool(workers int) *relayPool {
+	pool := &relayPool{jobs: make(chan func(), mediaQueueSize)}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// mediaWorkers returns the number of relay workers, set with the PONSE_MEDIA_WORKERS env
+func mediaWorkers() int {
+	value := os.Getenv("PONSE_MEDIA_WORKERS")
+	if value == "" {
+		return defaultMediaWorkers
+	}
+
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		log.Printf("Invalid PONSE_MEDIA_WORKERS %q, using %d\n", value, defaultMediaWorkers)
+		return defaultMediaWorkers
+	}
+
+	return workers
+}
+
+// work runs the queued relays one after the other
+func (p *relayPool) work() {
+	for job := range p.jobs {
+		p.queued.Add(-1)
+		p.active.Add(1)
+		job()
+		p.active.Add(-1)
+	}
+}
+
+// submit queues a relay, or runs it on a new goroutine if the queue is full
+func (p *relayPool) submit(job func()) {
+	p.queued.Add(1)
+	select {
+	case p.jobs <- job:
+	default:
+		p.queued.Add(-1)
+		p.overflowed.Add(1)
+		go job()
+	}
+}
+
+// Stats returns the number of relays running on the workers, waiting for one, and the total
+// that overflowed into their own goroutine
+func (p *relayPool) Stats() string {
+	return fmt.Sprintf("active=%d queued=%d overflowed=%d", p.active.Load(), p.queued.Load(), p.overflowed.Load())
+}
+
+// pooledKind returns whether the relays of a media kind run on the pool. VIDEO and AUDIO
+// connections last the whole session, so they keep dedicated goroutines
+func pooledKind(kind string) bool {
+	return kind != "VIDEO" && kind != "AUDIO"
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProtocolKind is a kind of value of the iRTSP protocol tracked by the registry
+type ProtocolKind string
+
+const (
+	// KindMethod is a message method, like "SETUP"
+	KindMethod ProtocolKind = "method"
+
+	// KindHeader is a header key, like "sc"
+	KindHeader ProtocolKind = "header"
+
+	// KindResponse is a method and the code the server answered it with, like "SETUP/200"
+	KindResponse ProtocolKind = "response"
+
+	// KindCode is a response code, like "200"
+	KindCode ProtocolKind = "code"
+
+	// KindTransport is a media transport protocol, like "tcp"
+	KindTransport ProtocolKind = "transport"
+)
+
+// protocolKinds are the kinds tracked by the registry, in the order they are listed
+var protocolKinds = []ProtocolKind{KindMethod, KindHeader, KindResponse, KindCode, KindTransport}
+
+// protocolDefaults are the values known to the proxy, by kind, with their definition. The values
+// observed in the field can be exported with "ponse protocol export" in the same format, to be
+// merged into the file
+//
+//go:embed protocol.json
+var protocolDefaults []byte
+
+// ProtocolDefinition is what the proxy knows about a value. Besides the description, the methods
+// tell how their messages are handled and checked, and the codes what they mean. The other kinds
+// only have a description
+type ProtocolDefinition struct {
+	Description string `json:"description,omitempty"`
+
+	// MethodInfo is how the proxy handles the server messages of a method
+	MethodInfo
+
+	// Request and Response are the headers expected on the requests and responses of a method.
+	// The messages without one aren't checked
+	Request  *HeaderSchema `json:"request,omitempty"`
+	Response *HeaderSchema `json:"response,omitempty"`
+
+	// ResponseCode is the meaning of a code
+	ResponseCode
+}
+
+// ProtocolEntry is a value of the protocol in the registry
+type ProtocolEntry struct {
+	Kind  ProtocolKind `json:"kind"`
+	Value string       `json:"value"`
+	ProtocolDefinition
+
+	// Known is whether the value is one of the defaults
+	Known bool `json:"known"`
+
+	// Count is the number of times the value was seen since the proxy started, and FirstSeen
+	// when it was seen first. FirstSeen is zero if it wasn't seen
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen,omitempty"`
+}
+
+// protocolRegistry holds every known or observed value of the protocol. It's the single place
+// the proxy learns what is known, and reports the values it never saw before
+var protocolRegistry = struct {
+	sync.Mutex
+	entries map[ProtocolKind]map[string]*ProtocolEntry
+}{entries: loadProtocolDefaults()}
+
+// loadProtocolDefaults reads the known values into registry entries
+func loadProtocolDefaults() map[ProtocolKind]map[string]*ProtocolEntry {
+	var defaults map[ProtocolKind]map[string]ProtocolDefinition
+	if err := json.Unmarshal(protocolDefaults, &defaults); err != nil {
+		panic(fmt.Sprintf("invalid protocol.json: %v", err))
+	}
+
+	entries := make(map[ProtocolKind]map[string]*ProtocolEntry)
+	for _, kind := range protocolKinds {
+		entries[kind] = make(map[string]*ProtocolEntry)
+		for value, definition := range defaults[kind] {
+			entries[kind][value] = &ProtocolEntry{Kind: kind, Value: value, ProtocolDefinition: definition, Known: true}
+		}
+	}
+
+	return entries
+}
+
+// knownProtocolValue returns whether a value is one of the defaults
+func knownProtocolValue(kind ProtocolKind, value string) bool {
+	_, ok := protocolDefinition(kind, value)
+	return ok
+}
+
+// protocolDefinition returns the definition of a value, and whether it's one of the defaults.
+// The definitions don't change once loaded, so the slices they hold can be shared
+func protocolDefinition(kind ProtocolKind, value string) (ProtocolDefinition, bool) {
+	protocolRegistry.Lock()
+	defer protocolRegistry.Unlock()
+
+	entry, ok := protocolRegistry.entries[kind][value]
+	if !ok || !entry.Known {
+		return ProtocolDefinition{}, false
+	}
+
+	return entry.ProtocolDefinition, true
+}
+
+// observeProtocol counts a value seen in the traffic. The first time a value that isn't known
+// is seen, it's reported as an anomaly, and observeProtocol returns true
+func observeProtocol(kind ProtocolKind, value string) bool {
+	protocolRegistry.Lock()
+	defer protocolRegistry.Unlock()
+
+	entry, ok := protocolRegistry.entries[kind][value]
+	if !ok {
+		entry = &ProtocolEntry{Kind: kind, Value: value}
+		protocolRegistry.entries[kind][value] = entry
+		log.Printf("[ANOMALY] Unknown %s %q seen for the first time\n", kind, value)
+	}
+
+	if entry.Count == 0 {
+		entry.FirstSeen = time.Now()
+	}
+	entry.Count++
+
+	return !ok
+}
+
+// observeMessage counts the method, header keys, response and code of a parsed message. The first
+// message with an unknown method is logged whole, to help exploring what it does
+func observeMessage(msg *Message) {
+	if observeProtocol(KindMethod, msg.Method) {
+		log.Printf("[ANOMALY] First message with the unknown method %s, sent by %s: %s\n", msg.Method, msg.Direction, msg)
+	}
+	for _, field := range msg.Headers.Fields() {
+		observeProtocol(KindHeader, field.Key)
+	}
+	if msg.IsResponse() {
+		observeProtocol(KindResponse, fmt.Sprintf("%s/%d", msg.Method, msg.Code))
+		observeProtocol(KindCode, strconv.Itoa(msg.Code))
+	}
+}
+
+// listProtocol returns the entries of the registry, by kind and value
+func listProtocol() []ProtocolEntry {
+	protocolRegistry.Lock()
+	defer protocolRegistry.Unlock()
+
+	var entries []ProtocolEntry
+	for _, kind := range protocolKinds {
+		for _, entry := range protocolRegistry.entries[kind] {
+			entries = append(entries, *entry)
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b ProtocolEntry) int {
+		if a.Kind != b.Kind {
+			return slices.Index(protocolKinds, a.Kind) - slices.Index(protocolKinds, b.Kind)
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+
+	return entries
+}
+
+// fetchProtocol returns the entries of the registry of the running proxy, from the debug server
+// set with PONSE_DEBUG_ADDR. Without it, the entries are the defaults, as nothing was observed
+func fetchProtocol() ([]ProtocolEntry, error) {
+	address := os.Getenv("PONSE_DEBUG_ADDR")
+	if address == "" {
+		return listProtocol(), nil
+	}
+
+	res, err := http.Get("http://" + address + "/protocol")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /protocol: %s", res.Status)
+	}
+
+	var entries []ProtocolEntry
+	return entries, json.NewDecoder(res.Body).Decode(&entries)
+}
+
+// printProtocol prints the registry of the running proxy, or the defaults if it isn't reachable
+// through PONSE_DEBUG_ADDR
+func printProtocol() error {
+	entries, err := fetchProtocol()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		status := "known"
+		if !entry.Known {
+			status = "UNKNOWN"
+		}
+
+		seen := "never seen"
+		if entry.Count > 0 {
+			seen = fmt.Sprintf("seen %d times since %s", entry.Count, entry.FirstSeen.Format(time.RFC3339))
+		}
+
+		fmt.Printf("%-9s %-12s %-7s %s", entry.Kind, entry.Value, status, seen)
+		if entry.Description != "" {
+			fmt.Printf(" - %s", entry.Description)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// exportProtocol prints the known and observed values in the format of protocol.json, so that
+// the values observed in the field can be merged into the defaults
+func exportProtocol() error {
+	entries, err := fetchProtocol()
+	if err != nil {
+		return err
+	}
+
+	export := make(map[ProtocolKind]map[string]ProtocolDefinition)
+	for _, entry := range entries {
+		if export[entry.Kind] == nil {
+			export[entry.Kind] = make(map[string]ProtocolDefinition)
+		}
+		export[entry.Kind][entry.Value] = entry.ProtocolDefinition
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
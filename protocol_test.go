@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestMethodInfo(t *testing.T) {
+	tests := []struct {
+		method string
+		info   MethodInfo
+	}{
+		{MethodOptions, MethodInfo{}},
+		{MethodStart, MethodInfo{StartsSession: true, Enters: ProtocolStarted}},
+		{MethodSetup, MethodInfo{Media: []MediaAnnouncement{
+			{Header: HeaderVideo, Kind: "VIDEO"},
+			{Header: HeaderAudio, Kind: "AUDIO"},
+			{Header: HeaderControl, Kind: "CONTROL"},
+		}, Enters: ProtocolSetup}},
+		{MethodKnock, MethodInfo{Media: []MediaAnnouncement{{Header: HeaderKnockPort, Kind: "KNOCK"}}, Enters: ProtocolKnocked}},
+		{"TEARDOWN", MethodInfo{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			got := methodInfo(test.method)
+			if !slices.Equal(got.Media, test.info.Media) || got.StartsSession != test.info.StartsSession || got.Enters != test.info.Enters {
+				t.Errorf("methodInfo(%s) = %+v, want %+v", test.method, got, test.info)
+			}
+		})
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	tests := []struct {
+		code  int
+		known bool
+		error bool
+		name  string
+	}{
+		{CodeOK, true, false, "200 OK"},
+		{CodeServiceUnavailable, true, true, "503 Service Unavailable"},
+		{204, false, false, "204 (unrecognized)"},
+		{450, false, true, "450 (unrecognized)"},
+	}
+
+	for _, test := range tests {
+		t.Run(describeCode(test.code), func(t *testing.T) {
+			code, known := responseCode(test.code)
+			if known != test.known || code.Error != test.error {
+				t.Errorf("responseCode(%d) = %+v, %v, want error=%v, %v", test.code, code, known, test.error, test.known)
+			}
+			if got := describeCode(test.code); got != test.name {
+				t.Errorf("describeCode(%d) = %q, want %q", test.code, got, test.name)
+			}
+		})
+	}
+}
+
+// TestObserveSession checks that the messages of a regular session are all known, so that none
+// of them is reported as an anomaly
+func TestObserveSession(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	session := append([]string{
+		"iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nSubmit\r\n",
+		"iRTSP/1.21\r\nSeq=1\r\nRSP/OPTIONS/200\r\nSubmit\r\n",
+		"iRTSP/1.21\r\nSeq=0\r\nRSP/START/200\r\nSubmit\r\n",
+		"iRTSP/1.21\r\nSeq=2\r\nSET/SETUP\r\nSubmit\r\n",
+		"iRTSP/1.21\r\nSeq=3\r\nSET/KNOCK\r\nSubmit\r\n",
+	}, testMessages...)
+
+	for _, raw := range session {
+		msg, err := NewMessage([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		observeMessage(msg)
+	}
+
+	if logs.Len() > 0 {
+		t.Errorf("regular session logged:\n%s", logs.String())
+	}
+}
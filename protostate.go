@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+)
+
+// ProtocolState is the stage of the iRTSP exchange a session is in, as announced by the methods
+// of the server
+type ProtocolState string
+
+const (
+	// ProtocolIdle is the state before the server announced anything
+	ProtocolIdle ProtocolState = "idle"
+
+	// ProtocolSetup is the state after SETUP, once the media streams are announced
+	ProtocolSetup ProtocolState = "setup"
+
+	// ProtocolKnocked is the state after KNOCK, once the KNOCK connection is announced
+	ProtocolKnocked ProtocolState = "knocked"
+
+	// ProtocolStarted is the state after START
+	ProtocolStarted ProtocolState = "started"
+
+	// ProtocolStopped is the state once the session ended
+	ProtocolStopped ProtocolState = "stopped"
+)
+
+// protocolStates are the states in the order a session goes through them
+var protocolStates = []ProtocolState{ProtocolIdle, ProtocolSetup, ProtocolKnocked, ProtocolStarted, ProtocolStopped}
+
+// next returns the state expected after s, or an empty state after ProtocolStopped
+func (s ProtocolState) next() ProtocolState {
+	i := slices.Index(protocolStates, s)
+	if i < 0 || i == len(protocolStates)-1 {
+		return ""
+	}
+
+	return protocolStates[i+1]
+}
+
+// ProtocolMachine follows the state of the iRTSP exchange of a session. The proxy decides from it
+// whether a START upgrades the connections or re-negotiates a session already started. A state
+// entered out of order or twice is logged as a warning, as it explains why a session went wrong,
+// like media never relayed after a START that came before SETUP. It's safe for concurrent use, to
+// be read by the debug server
+type ProtocolMachine struct {
+	mutex sync.Mutex
+	state ProtocolState
+
+	// entered are the states the session went through, including the current one
+	entered map[ProtocolState]bool
+
+	// anomalies counts the states entered out of order or twice
+	anomalies int
+}
+
+// newProtocolMachine creates a ProtocolMachine in the idle state
+func newProtocolMachine() *ProtocolMachine {
+	return &ProtocolMachine{state: ProtocolIdle, entered: map[ProtocolState]bool{ProtocolIdle: true}}
+}
+
+// State returns the current state
+func (m *ProtocolMachine) State() ProtocolState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.state
+}
+
+// observe enters the state of the method of a server message, from the method table, and returns
+// whether the session was already in that state before, like for a START re-negotiating a session
+// already started. The methods without a state, like the unknown ones, leave it unchanged
+func (m *ProtocolMachine) observe(msg *Message) bool {
+	next := methodInfo(msg.Method).Enters
+	if next == "" {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	again := m.entered[next]
+	m.entered[next] = true
+
+	cause := fmt.Sprintf("%s %s seq=%d", msg.Method, msg.Type, msg.Sequence)
+	switch expected := m.state.next(); next {
+	case m.state:
+		m.anomalies++
+		log.Printf("[SESSION] WARNING: protocol state %s entered again on %s\n", next, cause)
+		return again
+	case expected:
+		log.Printf("[SESSION] Protocol state %s -> %s on %s\n", m.state, next, cause)
+	default:
+		m.anomalies++
+		log.Printf("[SESSION] WARNING: protocol state %s -> %s out of order on %s, expected %s\n", m.state, next, cause, expected)
+	}
+	m.state = next
+
+	return again
+}
+
+// stop enters the stopped state when the session ends, which can happen in any state
+func (m *ProtocolMachine) stop(reason EndReason) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log.Printf("[SESSION] Protocol state %s -> %s (reason=%s)\n", m.state, ProtocolStopped, reason)
+	m.state = ProtocolStopped
+}
+
+// Describe returns the state and the number of anomalies in a single line, like
+// "started, 1 out of order or repeated"
+func (m *ProtocolMachine) Describe() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return fmt.Sprintf("%s, %d out of order or repeated", m.state, m.anomalies)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultMaxMessageSize is the size above which a message is rejected, if PONSE_MAX_MESSAGE_SIZE
+// isn't set. Messages are usually well under 1 KiB, so a larger one means the stream isn't
+// iRTSP or lost its framing
+const defaultMaxMessageSize = 64 * 1024
+
+// defaultMaxLineSize is the size above which a line of a message is rejected, if
+// PONSE_MAX_LINE_SIZE isn't set. Header values are short, the longest being the transports
+const defaultMaxLineSize = 4 * 1024
+
+// pendingReadTimeout is how long a side is waited for while the other side has bytes waiting to
+// be read, so that messages sent back to back aren't held up
+const pendingReadTimeout = 10 * time.Millisecond
+
+// MessageReader reads iRTSP messages from a stream. A read from the connection can hold part of
+// a message or several of them, so the stream is split on the Submit line instead, and exactly
+// one message is returned per call. Reading can be retried after a deadline error, the part of
+// the message already read is kept
+type MessageReader struct {
+	reader *bufio.Reader
+
+	// arrivals records when the bytes of the stream were read, to time the messages
+	arrivals *arrivalReader
+
+	// maxSize and maxLineSize are the sizes of a message and of one of its lines above which
+	// reading it fails with ErrMessageTooLarge
+	maxSize     int
+	maxLineSize int
+
+	// pending holds the lines of the message being read, and lineStart is where its last
+	// (possibly partial) line starts
+	pending   []byte
+	lineStart int
+
+	// raw is the last message read, and frame where and when it was received
+	raw   []byte
+	frame Frame
+
+	// offset is the position in the stream of the first byte of the message being read
+	offset int64
+}
+
+// overLimit returns whether an error of ReadMessage or NewMessage is a message over the size
+// limits. Such a message isn't forwarded as received like other invalid messages, and the
+// session is ended instead
+func overLimit(err error) bool {
+	return errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrTooManyHeaders)
+}
+
+// Frame is where and when a message was received. A read from the connection can end in the
+// middle of a message, so a message can start in one read and end in a later one, and end in
+// the same read as the next message starts. The times use the monotonic clock
+type Frame struct {
+	// Offset is the position of the first byte of the message in the stream, and Size its
+	// size in bytes
+	Offset int64
+	Size   int
+
+	// Start is when the first byte of the message was read, and End when the last one was
+	Start time.Time
+	End   time.Time
+}
+
+// arrival is the end of a read from the stream, and when it returned
+type arrival struct {
+	end int64
+	at  time.Time
+}
+
+// arrivalReader records when each read from the stream returned, and up to which position
+type arrivalReader struct {
+	reader   io.Reader
+	read     int64
+	arrivals []arrival
+}
+
+func (r *arrivalReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.read += int64(n)
+		r.arrivals = append(r.arrivals, arrival{end: r.read, at: time.Now()})
+	}
+	return n, err
+}
+
+// frame returns the frame of the bytes from offset to offset+size, and forgets the reads that
+// ended within them
+func (r *arrivalReader) frame(offset int64, size int) Frame {
+	frame := Frame{Offset: offset, Size: size}
+	end := offset + int64(size)
+
+	for i, arrival := range r.arrivals {
+		if frame.Start.IsZero() && arrival.end > offset {
+			frame.Start = arrival.at
+		}
+		if arrival.end >= end {
+			frame.End = arrival.at
+
+			// The read holding the last byte can also hold the start of the next message
+			if arrival.end == end {
+				i++
+			}
+			r.arrivals = r.arrivals[i:]
+			break
+		}
+	}
+
+	return frame
+}
+
+// NewMessageReader creates a MessageReader reading from r, with the size limits set with the
+// PONSE_MAX_MESSAGE_SIZE and PONSE_MAX_LINE_SIZE envs
+func NewMessageReader(r io.Reader) *MessageReader {
+	arrivals := &arrivalReader{reader: r}
+	return &MessageReader{reader: bufio.NewReader(arrivals), arrivals: arrivals, maxSize: maxMessageSize, maxLineSize: maxLineSize}
+}
+
+// ReadMessage reads the next message. If the message was read but can't be parsed, the parse
+// error is returned and Bytes still returns the message. Any other error comes from the stream
+func (r *MessageReader) ReadMessage() (*Message, error) {
+	// The last message is no longer needed, so its buffer is reused for the next one
+	if r.pending == nil && r.raw != nil {
+		r.pending = r.raw[:0]
+	}
+	r.raw = nil
+	r.frame = Frame{}
+
+	for {
+		line, err := r.reader.ReadSlice('\n')
+		r.pending = append(r.pending, line...)
+		if len(r.pending) > r.maxSize {
+			return nil, fmt.Errorf("%w: no Submit terminator in the first %d bytes", ErrMessageTooLarge, len(r.pending))
+		}
+		if lineSize := len(bytes.TrimRight(r.pending[r.lineStart:], "\r\n")); lineSize > r.maxLineSize {
+			return nil, fmt.Errorf("%w: line of more than %d bytes, the limit is %d", ErrMessageTooLarge, lineSize, r.maxLineSize)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && len(r.pending) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(bytes.TrimRight(r.pending[r.lineStart:], "\r\n"), []byte("Submit")) {
+			r.lineStart = len(r.pending)
+			continue
+		}
+
+		r.raw = r.pending
+		r.frame = r.arrivals.frame(r.offset, len(r.raw))
+		r.offset += int64(len(r.raw))
+		r.pending = nil
+		r.lineStart = 0
+
+		msg, err := NewMessage(r.raw)
+		if msg != nil {
+			msg.Timestamp = r.frame.End
+		}
+		return msg, err
+	}
+}
+
+// Bytes returns the message read by the last call to ReadMessage, as it was received. It's nil
+// if no message was read. The bytes are reused by the next call to ReadMessage, so they have to
+// be copied to be kept. The Message returned holds its own copy
+func (r *MessageReader) Bytes() []byte {
+	return r.raw
+}
+
+// Frame returns where and when the message returned by the last call to ReadMessage was
+// received. It's the zero Frame if no message was read
+func (r *MessageReader) Frame() Frame {
+	return r.frame
+}
+
+// Buffered returns whether bytes of the stream were read ahead and are waiting to be returned
+func (r *MessageReader) Buffered() bool {
+	return len(r.pending) > 0 || r.reader.Buffered() > 0
+}
+
+// Unread returns the bytes read ahead from the stream and discards them from the reader, for
+// when the stream switches to another protocol like TLS
+func (r *MessageReader) Unread() []byte {
+	unread := r.pending
+	buffered, _ := r.reader.Peek(r.reader.Buffered())
+	unread = append(unread, buffered...)
+
+	r.reader.Discard(len(buffered))
+	r.offset += int64(len(unread))
+	r.arrivals.arrivals = nil
+	r.pending = nil
+	r.lineStart = 0
+
+	return unread
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// framesPerSession is the number of messages or media frames of the allocation benchmarks, a
+// stream at 30fps for 10 seconds
+const framesPerSession = 300
+
+// chunkReader returns its chunks one per read, like a connection returning what each segment
+// brought
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// readAll reads the messages of a stream until it ends, and fails the test on any other error
+func readAll(t *testing.T, reader *MessageReader) []*Message {
+	t.Helper()
+
+	var messages []*Message
+	for {
+		msg, err := reader.ReadMessage()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatalf("ReadMessage() after %d messages: %v", len(messages), err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestMessageReaderSplitReads(t *testing.T) {
+	start, setup := testMessages[0], testMessages[1]
+	submit := strings.Index(start, "Submit")
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"one message per read", []string{start, setup}, []string{start, setup}},
+		{"Submit in a separate read", []string{start[:submit], start[submit:]}, []string{start}},
+		{"terminator split in its line ending", []string{start[:len(start)-1], start[len(start)-1:]}, []string{start}},
+		{"two messages in one read", []string{start + setup}, []string{start, setup}},
+		{"next message starting in the same read", []string{start + setup[:10], setup[10:]}, []string{start, setup}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := append([]string(nil), test.chunks...)
+			messages := readAll(t, NewMessageReader(&chunkReader{chunks: chunks}))
+			if len(messages) != len(test.want) {
+				t.Fatalf("read %d messages, want %d", len(messages), len(test.want))
+			}
+			for i, msg := range messages {
+				if string(msg.Raw) != test.want[i] {
+					t.Errorf("message %d = %q, want %q", i, msg.Raw, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// chunked splits a stream into chunks of the given size
+func chunked(stream string, size int) []string {
+	var chunks []string
+	for len(stream) > size {
+		chunks = append(chunks, stream[:size])
+		stream = stream[size:]
+	}
+	return append(chunks, stream)
+}
+
+func TestMessageReaderLargeMessage(t *testing.T) {
+	// A SETUP response with a long capability list, well over the 1024 bytes of a single read
+	builder := &strings.Builder{}
+	builder.WriteString("iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\n")
+	for i := 0; builder.Len() < 3*1024; i++ {
+		builder.WriteString("cap" + strconv.Itoa(i) + "=iDataChunk/unicast/tcp/40603\r\n")
+	}
+	builder.WriteString("Submit\r\n")
+	large := builder.String()
+
+	messages := readAll(t, NewMessageReader(&chunkReader{chunks: chunked(large+testMessages[0], 200)}))
+	if len(messages) != 2 {
+		t.Fatalf("read %d messages, want the large one then START", len(messages))
+	}
+	if string(messages[0].Raw) != large {
+		t.Errorf("large message = %q, want %q", messages[0].Raw, large)
+	}
+	if headers := strings.Count(large, "\r\n") - 4; messages[0].Headers.Len() != headers {
+		t.Errorf("large message has %d headers, want %d", messages[0].Headers.Len(), headers)
+	}
+	if messages[1].Method != MethodStart {
+		t.Errorf("message after the large one = %s, want START", messages[1])
+	}
+}
+
+func TestMessageReaderTruncatedStream(t *testing.T) {
+	reader := NewMessageReader(strings.NewReader(testMessages[0] + testMessages[1][:20]))
+	if _, err := reader.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reader.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadMessage() of a truncated message error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func BenchmarkMessageReader(b *testing.B) {
+	msg := "iRTSP/1.21\r\nSeq=3\r\nRSP/START/200\r\nv=iDataChunk/unicast/tcp/40603\r\nt=1429051\r\nSubmit\r\n"
+	stream := strings.Repeat(msg, framesPerSession)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := NewMessageReader(strings.NewReader(stream))
+		for n := 0; n < framesPerSession; n++ {
+			if _, err := reader.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+}
+
+func TestMessageReaderAliasing(t *testing.T) {
+	first := "iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nt=1\r\nSubmit\r\n"
+	second := "iRTSP/1.21\r\nSeq=2\r\nSET/OPTIONS\r\nt=2\r\nSubmit\r\n"
+	reader := NewMessageReader(strings.NewReader(first + second))
+
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := reader.Bytes()
+	if string(received) != first {
+		t.Fatalf("Bytes() = %q, want %q", received, first)
+	}
+
+	if _, err := reader.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffer of the first message holds the second one now
+	if !bytes.Equal(received, reader.Bytes()) {
+		t.Errorf("Bytes() of the first message = %q after the next read, want it reused for %q", received, second)
+	}
+
+	// The message keeps its own copy
+	if string(msg.Raw) != first || string(msg.ToBytes()) != first {
+		t.Errorf("first message bytes = %q, want %q", msg.Raw, first)
+	}
+	if value := msg.Headers.Get("t"); msg.Sequence != 1 || value != "1" {
+		t.Errorf("first message = %s with t=%s, want Seq 1 with t=1", msg, value)
+	}
+}
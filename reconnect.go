@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultReconnectWindow is how soon after an abnormal end a new connection from the same client
+// is treated as a reconnect, if PONSE_RECONNECT_WINDOW isn't set
+const defaultReconnectWindow = 30 * time.Second
+
+// lastConnectionID is the ID of the last control connection accepted
+var lastConnectionID atomic.Int64
+
+// abnormalEnd is a logical session whose last connection ended abnormally
+type abnormalEnd struct {
+	logicalID  int64
+	reconnects int
+	endedAt    time.Time
+}
+
+// abnormalEnds holds the last abnormal end of each client IP, to correlate the reconnects
+var abnormalEnds = struct {
+	sync.Mutex
+	clients map[string]abnormalEnd
+}{clients: make(map[string]abnormalEnd)}
+
+// reconnectWindow returns the reconnect window, set with the PONSE_RECONNECT_WINDOW env as a Go duration
+func reconnectWindow() time.Duration {
+	if window := envDuration("PONSE_RECONNECT_WINDOW"); window > 0 {
+		return window
+	}
+
+	return defaultReconnectWindow
+}
+
+// clientIP returns the IP of a client address, or the whole address if it has no port
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// assignSessionIDs gives the session a new connection ID. When the client dropped its previous
+// connection abnormally within the reconnect window, like when its Wi-Fi hiccups, the session
+// keeps the logical ID of the previous one. Otherwise a new logical session starts
+func assignSessionIDs(session *Session, addr net.Addr) {
+	session.ID = lastConnectionID.Add(1)
+	session.LogicalID = session.ID
+
+	abnormalEnds.Lock()
+	defer abnormalEnds.Unlock()
+
+	ip := clientIP(addr)
+	previous, ok := abnormalEnds.clients[ip]
+	if !ok {
+		return
+	}
+	delete(abnormalEnds.clients, ip)
+
+	if time.Since(previous.endedAt) > reconnectWindow() {
+		return
+	}
+
+	session.LogicalID = previous.logicalID
+	session.Reconnects = previous.reconnects + 1
+	log.Printf("[SESSION] Connection %d from %s is reconnect %d of session %d\n", session.ID, ip, session.Reconnects, session.LogicalID)
+}
+
+// recordSessionEnd remembers a session that ended abnormally, so that a reconnect from the same
+// client can be linked to it
+func recordSessionEnd(session *Session, addr net.Addr, abnormal bool) {
+	if !abnormal {
+		return
+	}
+
+	abnormalEnds.Lock()
+	defer abnormalEnds.Unlock()
+
+	abnormalEnds.clients[clientIP(addr)] = abnormalEnd{
+		logicalID:  session.LogicalID,
+		reconnects: session.Reconnects,
+		endedAt:    time.Now(),
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRefusalCode is the code a refused client is answered with if the reason has no template.
+// It's the RTSP "Service Unavailable" code, as the error codes of iRTSP are unknown
+const defaultRefusalCode = CodeServiceUnavailable
+
+// defaultRetryHeader is the header carrying the retry hint if PONSE_REFUSAL_RETRY_HEADER isn't set
+const defaultRetryHeader = "retry"
+
+// refusalTemplate is the response sent to a client that can't be served
+type refusalTemplate struct {
+	// Code is the response code
+	Code int
+
+	// RetryAfter is the retry hint sent with the response, in seconds. It's zero to send no hint
+	RetryAfter time.Duration
+}
+
+// refusalFor returns the response template of a refusal reason, set with the
+// PONSE_REFUSAL_<REASON> env as "code[,retry after]", like PONSE_REFUSAL_BUDGET_EXHAUSTED="503,1h".
+// Which codes the console renders nicely is still unknown, so each reason can be tried separately
+func refusalFor(reason EndReason) refusalTemplate {
+	template := refusalTemplate{Code: defaultRefusalCode}
+
+	env := "PONSE_REFUSAL_" + strings.ToUpper(string(reason))
+	value := os.Getenv(env)
+	if value == "" {
+		return template
+	}
+
+	code, retryAfter, _ := strings.Cut(value, ",")
+	parsed, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s code %q, using %d\n", env, code, defaultRefusalCode)
+	} else {
+		template.Code = parsed
+	}
+
+	if retryAfter != "" {
+		duration, err := time.ParseDuration(strings.TrimSpace(retryAfter))
+		if err != nil {
+			log.Printf("Invalid %s retry hint %q: %v\n", env, retryAfter, err)
+		} else {
+			template.RetryAfter = duration
+		}
+	}
+
+	return template
+}
+
+// retryHeader returns the header carrying the retry hint, set with the PONSE_REFUSAL_RETRY_HEADER env
+func retryHeader() string {
+	if header := os.Getenv("PONSE_REFUSAL_RETRY_HEADER"); header != "" {
+		return header
+	}
+
+	return defaultRetryHeader
+}
+
+// rejectClient answers the first request of the client with the response template of the
+// refusal reason, so that the client doesn't wait for a server that won't be dialed, and
+// shows an error right away instead of timing out
+func rejectClient(conn net.Conn, reason EndReason) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	req, err := NewMessageReader(conn).ReadMessage()
+	if err != nil {
+		log.Printf("[SESSION] Refused client (reason=%s) without a response, its first request couldn't be read: %v\n", reason, err)
+		return
+	}
+
+	template := refusalFor(reason)
+	var headers []Header
+	if template.RetryAfter > 0 {
+		headers = append(headers, Header{Key: retryHeader(), Value: strconv.Itoa(int(template.RetryAfter.Seconds()))})
+	}
+
+	// Answer in the version and sequence of the request
+	res := NewResponse(req.Method, template.Code, headers...)
+	res.Version = req.Version
+	res.Sequence = req.Sequence
+	res.WriteTo(conn)
+
+	log.Printf("[SESSION] Refused client %s request (reason=%s) with code %d:\n%s\n", req.Method, reason, template.Code, res.Verbose())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RelayStrategy determines how the data of a media connection is relayed
+type RelayStrategy string
+
+const (
+	// RelayFast copies the data between both connections without looking at it. On TCP this
+	// lets the system avoid copying the data into the proxy
+	RelayFast RelayStrategy = "fast"
+
+	// RelayBuffered reads the data into the proxy and logs every chunk that is relayed
+	RelayBuffered RelayStrategy = "buffered"
+
+	// RelayInspected is like RelayBuffered, but also dumps the contents of every chunk
+	RelayInspected RelayStrategy = "inspected"
+)
+
+// defaultRelayStrategies are the strategies used for each media kind if none is configured.
+// The stream data is too large to be logged, while the other kinds are small enough to be
+// dumped entirely
+var defaultRelayStrategies = map[string]RelayStrategy{
+	"VIDEO":   RelayFast,
+	"AUDIO":   RelayFast,
+	"CONTROL": RelayInspected,
+	"KNOCK":   RelayInspected,
+}
+
+// mediaBufferSize is the size of the buffers the media chunks are read into
+const mediaBufferSize = 1024
+
+// mediaBuffers holds the buffers of the media relays that aren't running, as a relay reads tens
+// of chunks per second, each of which would otherwise be a new buffer for the garbage collector.
+// A chunk is written to the other side before the next one is read, so a relay only needs one.
+// The pool holds pointers, as storing a slice in an interface would allocate
+var mediaBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, mediaBufferSize)
+		return &buffer
+	},
+}
+
+// relayStrategy returns the strategy used for the given media kind and network.
+//
+// The strategies can be overridden with the PONSE_RELAY_STRATEGIES env as a comma-separated
+// list of KIND=STRATEGY entries. Example: VIDEO=buffered,KNOCK=fast
+func relayStrategy(kind, network string) RelayStrategy {
+	strategy, ok := defaultRelayStrategies[kind]
+	if !ok {
+		strategy = RelayBuffered
+	}
+
+	for _, entry := range strings.Split(os.Getenv("PONSE_RELAY_STRATEGIES"), ",") {
+		entryKind, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || !strings.EqualFold(entryKind, kind) {
+			continue
+		}
+
+		switch configured := RelayStrategy(strings.ToLower(value)); configured {
+		case RelayFast, RelayBuffered, RelayInspected:
+			strategy = configured
+		default:
+			log.Printf("[%s] Unknown relay strategy %q, using %s\n", kind, value, strategy)
+		}
+	}
+
+	// The UDP connections need their datagrams to be redirected one by one, so they can't
+	// be copied directly
+	if network == "udp" && strategy == RelayFast {
+		strategy = RelayBuffered
+	}
+
+	return strategy
+}
+
+// mediaNetwork returns the network a media transport header is relayed over, or an empty
+// string if the header is invalid
+func mediaNetwork(header string) string {
+	transport, err := ParseTransport(header)
+	if err != nil {
+		return ""
+	}
+
+	return transport.Network()
+}
+
+// maxEmptyReads is the number of consecutive empty reads after which a stream relay stops.
+// Read is allowed to return no data without an error, but doing so repeatedly would make the
+// relay spin
+const maxEmptyReads = 100
+
+// emptyReads counts the reads of a relay direction that returned no data
+type emptyReads struct {
+	// consecutive is the number of empty reads since the last one with data
+	consecutive int
+
+	// reads is the total number of empty reads on a stream connection
+	reads int
+
+	// datagrams is the total number of empty datagrams received
+	datagrams int
+}
+
+// check is called after every read that didn't fail, and returns whether the data read should
+// be forwarded. An error is returned if the relay should stop.
+//
+// Empty datagrams are a real message on UDP, but some servers treat them as an error, so they
+// are only forwarded if the PONSE_FORWARD_EMPTY_DATAGRAMS env is set
+func (e *emptyReads) check(network string, n int) (bool, error) {
+	if n > 0 {
+		e.consecutive = 0
+		return true, nil
+	}
+
+	if network == "udp" {
+		e.datagrams++
+		return len(os.Getenv("PONSE_FORWARD_EMPTY_DATAGRAMS")) > 0, nil
+	}
+
+	e.reads++
+	e.consecutive++
+	if e.consecutive >= maxEmptyReads {
+		return false, fmt.Errorf("%w: %d consecutive empty reads", ErrRelayStalled, e.consecutive)
+	}
+
+	return false, nil
+}
+
+// envDuration reads a Go duration from an env, returning 0 if it isn't set or is invalid
+func envDuration(env string) time.Duration {
+	value := os.Getenv(env)
+	if value == "" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q: %v\n", env, value, err)
+		return 0
+	}
+
+	return duration
+}
+
+// mediaRelayContext derives the context of a media relay from the context of its session. The
+// relay is canceled with ErrMediaLifetime once it has run for PONSE_MEDIA_MAX_LIFETIME, and with
+// ErrMediaIdle if no data is relayed for PONSE_MEDIA_IDLE_TIMEOUT. The returned touch function
+// marks the relay as active, and is nil if there is no idle timeout
+func mediaRelayContext(parent context.Context) (context.Context, context.CancelCauseFunc, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	if lifetime := envDuration("PONSE_MEDIA_MAX_LIFETIME"); lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() { cancel(ErrMediaLifetime) })
+		context.AfterFunc(ctx, func() { timer.Stop() })
+	}
+
+	idleTimeout := envDuration("PONSE_MEDIA_IDLE_TIMEOUT")
+	if idleTimeout <= 0 {
+		return ctx, cancel, nil
+	}
+
+	lastActivity := &atomic.Int64{}
+	touch := func() { lastActivity.Store(time.Now().UnixNano()) }
+	touch()
+
+	go func() {
+		ticker := time.NewTicker(max(idleTimeout/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastActivity.Load())) > idleTimeout {
+					cancel(ErrMediaIdle)
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, cancel, touch
+}
+
+// relayEndReason returns why a relay direction stopped, given the error it stopped with. The
+// cause of the relay context takes precedence, as canceling it makes the reads fail too
+func relayEndReason(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	// io.Copy returns no error when the source reaches EOF
+	if err == nil {
+		return io.EOF
+	}
+
+	return err
+}
+
+// touchReader is a reader that marks the relay as active on every read
+type touchReader struct {
+	reader io.Reader
+	touch  func()
+}
+
+// Read reads from the underlying reader and marks the relay as active
+func (r *touchReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+
+	return n, err
+}
+
+// writeFull writes the whole buffer, writing again after short writes. net.Conn writes are
+// already complete on success, but writers wrapping them don't have to be
+func writeFull(w io.Writer, p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := w.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		// A writer making no progress without an error would loop forever
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func BenchmarkMediaRelay(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(address string) { serverAddress = address }(serverAddress)
+	serverAddress = "127.0.0.1"
+
+	// VIDEO is relayed with io.Copy by default, which doesn't read into the pooled buffers
+	b.Setenv("PONSE_RELAY_STRATEGIES", "VIDEO=buffered")
+
+	// The upstream closes once it read the whole stream, as the relay only ends when both
+	// directions do
+	frame := bytes.Repeat([]byte{0xab}, 1000)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.CopyN(io.Discard, conn, framesPerSession*int64(len(frame)))
+				conn.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, proxy := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleMediaConnection(context.Background(), proxy, "tcp", port, "VIDEO", nil, &MediaConnection{})
+			close(done)
+		}()
+
+		for n := 0; n < framesPerSession; n++ {
+			if _, err := client.Write(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+		client.Close()
+		<-done
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+}
+
+// shortWriter accepts at most limit bytes per write, and fails with err in the write that
+// reaches failAfter bytes, returning the bytes it wrote with the error. A negative failAfter
+// never fails
+type shortWriter struct {
+	limit     int
+	failAfter int
+	err       error
+	written   bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	n := min(len(p), w.limit)
+	if w.failAfter >= 0 && w.written.Len()+n >= w.failAfter {
+		n = w.failAfter - w.written.Len()
+		w.written.Write(p[:n])
+		return n, w.err
+	}
+
+	w.written.Write(p[:n])
+	return n, nil
+}
+
+func TestWriteFull(t *testing.T) {
+	data := []byte("iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nSubmit\r\n")
+	errBroken := errors.New("broken pipe")
+
+	tests := []struct {
+		name    string
+		writer  *shortWriter
+		written int
+		err     error
+	}{
+		{"whole write", &shortWriter{limit: len(data), failAfter: -1}, len(data), nil},
+		{"partial writes", &shortWriter{limit: 7, failAfter: -1}, len(data), nil},
+		{"no progress", &shortWriter{limit: 0, failAfter: -1}, 0, io.ErrShortWrite},
+		{"error after a partial write", &shortWriter{limit: 10, failAfter: 15, err: errBroken}, 15, errBroken},
+		{"error on the first write", &shortWriter{limit: 10, failAfter: 0, err: errBroken}, 0, errBroken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := writeFull(test.writer, data)
+			if n != test.written || !errors.Is(err, test.err) {
+				t.Errorf("writeFull() = %d, %v, want %d, %v", n, err, test.written, test.err)
+			}
+			if !bytes.Equal(test.writer.written.Bytes(), data[:n]) {
+				t.Errorf("written bytes = %q, want %q", test.writer.written.Bytes(), data[:n])
+			}
+		})
+	}
+}
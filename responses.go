@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// responseKind is a method and the code the server answered it with
+type responseKind struct {
+	Method string
+	Code   int
+}
+
+// ResponseCodes counts the responses of the server by method and code
+type ResponseCodes map[responseKind]int
+
+// Describe returns the counts in a single line, like "OPTIONS/200=1 SETUP/200=2", sorted by
+// method and code
+func (c ResponseCodes) Describe() string {
+	if len(c) == 0 {
+		return "none"
+	}
+
+	kinds := make([]responseKind, 0, len(c))
+	for kind := range c {
+		kinds = append(kinds, kind)
+	}
+	slices.SortFunc(kinds, func(a, b responseKind) int {
+		if n := strings.Compare(a.Method, b.Method); n != 0 {
+			return n
+		}
+		return a.Code - b.Code
+	})
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s/%d=%d", kind.Method, kind.Code, c[kind])
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// recordResponse counts a response of the server in the session. The responses of every session
+// are counted in the protocol registry. Error responses are logged as a warning, as they would
+// otherwise scroll by with the rest of the messages
+func (s *Session) recordResponse(res *Message) {
+	if !res.IsResponse() {
+		return
+	}
+
+	s.ResponseCodes[responseKind{Method: res.Method, Code: res.Code}]++
+
+	if res.IsError() {
+		s.ErrorResponses++
+		log.Printf("[SERVER] WARNING: %s answered with the error code %s (seq=%d)\n", res.Method, describeCode(res.Code), res.Sequence)
+	}
+}
+
+// describeResponseCodes returns the response counts of every session since the proxy started,
+// from the protocol registry, in a single line
+func describeResponseCodes() string {
+	var parts []string
+	for _, entry := range listProtocol() {
+		if entry.Kind == KindResponse && entry.Count > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", entry.Value, entry.Count))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+
+	return strings.Join(parts, " ")
+}
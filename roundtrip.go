@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultResponseTimeout is how long a request can wait for its response before it's reported
+// as unanswered, if PONSE_RESPONSE_TIMEOUT isn't set
+const defaultResponseTimeout = 10 * time.Second
+
+// RoundTrips pairs the requests of each side with the responses of the other side, by sequence
+// number, and measures how long the responses took. A response carries the sequence of the
+// request it answers, so a request is keyed by the side that sent it and its sequence
+type RoundTrips struct {
+	timeout time.Duration
+
+	// pending holds the requests waiting for their response
+	pending map[pendingKey]pendingRequest
+
+	// Latency holds the round-trip times of the answered requests, by method
+	Latency map[string][]time.Duration
+
+	// Unanswered counts the requests that got no response within the timeout, or whose
+	// sequence was reused before they got one
+	Unanswered int
+}
+
+// pendingKey identifies a request waiting for its response
+type pendingKey struct {
+	direction string
+	sequence  int
+}
+
+// pendingRequest is a request waiting for its response
+type pendingRequest struct {
+	method string
+	sent   time.Time
+}
+
+// newRoundTrips creates the correlation of a session, with the response timeout set with the
+// PONSE_RESPONSE_TIMEOUT env. Each control connection has its own, so the sequence numbers
+// reused by a reconnecting console don't match the requests of the previous connection
+func newRoundTrips() *RoundTrips {
+	timeout := envDuration("PONSE_RESPONSE_TIMEOUT")
+	if timeout <= 0 {
+		timeout = defaultResponseTimeout
+	}
+
+	return &RoundTrips{
+		timeout: timeout,
+		pending: make(map[pendingKey]pendingRequest),
+		Latency: make(map[string][]time.Duration),
+	}
+}
+
+// observe records a request read by the proxy, or pairs a response with its request
+func (r *RoundTrips) observe(msg *Message) {
+	if !msg.IsResponse() {
+		key := pendingKey{direction: msg.Direction, sequence: msg.Sequence}
+		if previous, ok := r.pending[key]; ok {
+			r.Unanswered++
+			log.Printf("[ANOMALY] %s %s seq=%d got no response before its sequence was reused by %s\n", msg.Direction, previous.method, msg.Sequence, msg.Method)
+		}
+		r.pending[key] = pendingRequest{method: msg.Method, sent: msg.Timestamp}
+		return
+	}
+
+	// The response answers a request of the other side
+	key := pendingKey{direction: otherSide(msg.Direction), sequence: msg.Sequence}
+	request, ok := r.pending[key]
+	if !ok {
+		log.Printf("[ANOMALY] %s response %s/%d seq=%d answers no pending request\n", msg.Direction, msg.Method, msg.Code, msg.Sequence)
+		return
+	}
+	delete(r.pending, key)
+
+	if request.method != msg.Method {
+		log.Printf("[ANOMALY] %s response seq=%d is for %s, the request was %s\n", msg.Direction, msg.Sequence, msg.Method, request.method)
+	}
+
+	roundTrip := msg.Timestamp.Sub(request.sent)
+	r.Latency[request.method] = appendLatency(r.Latency[request.method], roundTrip)
+	log.Printf("[%s] %s seq=%d -> %d in %v\n", key.direction, request.method, msg.Sequence, msg.Code, roundTrip.Round(time.Microsecond))
+}
+
+// expire reports the requests that waited for their response longer than the timeout, and
+// stops waiting for them
+func (r *RoundTrips) expire(now time.Time) {
+	for key, request := range r.pending {
+		if waited := now.Sub(request.sent); waited > r.timeout {
+			r.Unanswered++
+			delete(r.pending, key)
+			log.Printf("[ANOMALY] %s %s seq=%d got no response in %v\n", key.direction, request.method, key.sequence, waited.Round(time.Millisecond))
+		}
+	}
+}
+
+// Describe formats the round-trip times of each method, and the unanswered requests, in a
+// single line. The requests still pending when the session ends count as unanswered
+func (r *RoundTrips) Describe() string {
+	methods := make([]string, 0, len(r.Latency))
+	for method := range r.Latency {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+
+	parts := make([]string, 0, len(methods)+1)
+	for _, method := range methods {
+		parts = append(parts, fmt.Sprintf("%s %s", method, describeLatency(r.Latency[method])))
+	}
+	parts = append(parts, fmt.Sprintf("unanswered=%d", r.Unanswered+len(r.pending)))
+
+	return strings.Join(parts, ", ")
+}
+
+// otherSide returns the side receiving the messages of the given side
+func otherSide(direction string) string {
+	if direction == "CLIENT" {
+		return "SERVER"
+	}
+
+	return "CLIENT"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
+// HeaderSchema are the headers expected on the messages of a method. They are set for the
+// requests and responses of each method in protocol.json, as found so far
+type HeaderSchema struct {
+	// Required are the headers the message must have, with a value
+	Required []string `json:"required,omitempty"`
+
+	// Flags are the headers the message must have, with or without a value, like the bare "sc"
+	// of a plaintext START
+	Flags []string `json:"flags,omitempty"`
+
+	// Optional are the other headers the message is known to have
+	Optional []string `json:"optional,omitempty"`
+}
+
+// headerSchema returns the schema of the messages of a method and type from the protocol
+// registry, and whether there is one
+func headerSchema(method string, messageType MessageType) (*HeaderSchema, bool) {
+	definition, _ := protocolDefinition(KindMethod, method)
+	schema := definition.Request
+	if messageType == MessageResponse {
+		schema = definition.Response
+	}
+
+	return schema, schema != nil
+}
+
+// ProblemKind is how a message doesn't match its schema
+type ProblemKind string
+
+const (
+	// ProblemMissing is a required header or flag the message doesn't have
+	ProblemMissing ProblemKind = "missing"
+
+	// ProblemEmpty is a required header without a value, like "v" or "v="
+	ProblemEmpty ProblemKind = "empty"
+
+	// ProblemUnexpected is a header that is neither required nor optional
+	ProblemUnexpected ProblemKind = "unexpected"
+
+	// ProblemAmbiguous is a header line with more than one equal sign, which the parser had to
+	// guess the key of
+	ProblemAmbiguous ProblemKind = "ambiguous"
+
+	// ProblemVersion is a version line whose revision can't be parsed, kept as received
+	ProblemVersion ProblemKind = "version"
+)
+
+// Problem is something in a message that the proxy accepts but that is out of the spec, or a
+// header that doesn't match the schema of its method
+type Problem struct {
+	Kind ProblemKind
+
+	// Header is the key of the header, if the problem is about one
+	Header string
+
+	// Detail is the ambiguous line, or why the version can't be parsed
+	Detail string
+}
+
+// Serious returns whether the problem keeps the proxy from handling the message, as opposed to a
+// header the schema doesn't list yet or a line the parser could make sense of
+func (p Problem) Serious() bool {
+	return p.Kind == ProblemMissing || p.Kind == ProblemEmpty
+}
+
+// String describes the problem, like "missing required header v"
+func (p Problem) String() string {
+	switch p.Kind {
+	case ProblemUnexpected:
+		return fmt.Sprintf("unexpected header %s", p.Header)
+	case ProblemAmbiguous:
+		return fmt.Sprintf("ambiguous header line %q, parsed with the key %q", p.Detail, p.Header)
+	case ProblemVersion:
+		return fmt.Sprintf("%s, keeping the version as received", p.Detail)
+	}
+
+	return fmt.Sprintf("%s required header %s", p.Kind, p.Header)
+}
+
+// Problems returns what is out of the spec in a message but was still parsed leniently: a version
+// whose revision can't be parsed, and ambiguous header lines. The parser doesn't log them, as
+// messages are parsed again outside of the proxy loop, like by the audit
+func (m *Message) Problems() []Problem {
+	var problems []Problem
+	if _, err := ParseVersion(m.Version); err != nil {
+		problems = append(problems, Problem{Kind: ProblemVersion, Detail: err.Error()})
+	}
+
+	for _, field := range m.Headers.Fields() {
+		if field.Ambiguous {
+			problems = append(problems, Problem{Kind: ProblemAmbiguous, Header: field.Key, Detail: field.Raw})
+		}
+	}
+
+	return problems
+}
+
+// Validate checks the headers of a message against the schema of its method and type, and returns
+// the problems found, in the order of the schema then of the message. It's empty if the message
+// matches, or if there is no schema for it
+func Validate(msg *Message) []Problem {
+	schema, ok := headerSchema(msg.Method, msg.Type)
+	if !ok {
+		return nil
+	}
+
+	var problems []Problem
+	for _, key := range schema.Required {
+		value, ok := msg.Headers.Lookup(key)
+		switch {
+		case !ok:
+			problems = append(problems, Problem{Kind: ProblemMissing, Header: key})
+		case value == "":
+			problems = append(problems, Problem{Kind: ProblemEmpty, Header: key})
+		}
+	}
+	for _, key := range schema.Flags {
+		if _, ok := msg.Headers.Lookup(key); !ok {
+			problems = append(problems, Problem{Kind: ProblemMissing, Header: key})
+		}
+	}
+
+	reported := make(map[string]bool)
+	for _, field := range msg.Headers.Fields() {
+		key := field.Key
+		if reported[key] || slices.Contains(schema.Required, key) || slices.Contains(schema.Flags, key) || slices.Contains(schema.Optional, key) {
+			continue
+		}
+		reported[key] = true
+		problems = append(problems, Problem{Kind: ProblemUnexpected, Header: key})
+	}
+
+	return problems
+}
+
+// logProblems logs the problems of a message read by the proxy, then validates it. They are only
+// logged, the message being forwarded anyway: the parsing ones as anomalies, the serious schema
+// ones as a warning, and the headers the schema doesn't list yet as a hint for the reverse
+// engineering
+func logProblems(msg *Message) {
+	for _, problem := range msg.Problems() {
+		log.Printf("[ANOMALY] %s %s %s seq=%d: %s\n", msg.Direction, msg.Method, msg.Type, msg.Sequence, problem)
+	}
+
+	for _, problem := range Validate(msg) {
+		if problem.Serious() {
+			log.Printf("[SCHEMA] WARNING: %s %s %s seq=%d: %s\n", msg.Direction, msg.Method, msg.Type, msg.Sequence, problem)
+		} else {
+			log.Printf("[SCHEMA] %s %s %s seq=%d: %s\n", msg.Direction, msg.Method, msg.Type, msg.Sequence, problem)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		problems []Problem
+	}{
+		{"START with sc=tls", testMessages[0], nil},
+		{"START with a bare sc", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\nSubmit\r\n", nil},
+		{"START with an empty sc", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc=\r\nt=1429051\r\nSubmit\r\n", nil},
+		{"START without sc", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nt=1429051\r\nSubmit\r\n", []Problem{{Kind: ProblemMissing, Header: HeaderScheme}}},
+		{"START with a bare t", "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt\r\nSubmit\r\n", []Problem{{Kind: ProblemEmpty, Header: HeaderTime}}},
+		{"SETUP response", testMessages[1], nil},
+		{"SETUP response with an extra header", "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nv=a\r\na=b\r\nc=d\r\nx=1\r\nSubmit\r\n", []Problem{{Kind: ProblemUnexpected, Header: "x"}}},
+		{"no schema", "iRTSP/1.21\r\nSeq=1\r\nSET/OPTIONS\r\nx=1\r\nSubmit\r\n", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := Validate(msg); !slices.Equal(got, test.problems) {
+				t.Errorf("Validate() = %v, want %v", got, test.problems)
+			}
+		})
+	}
+}
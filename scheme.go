@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// schemeKind is which of the schemes a Scheme is
+type schemeKind int
+
+const (
+	schemeAbsent schemeKind = iota
+	schemeNone
+	schemeTLS
+	schemeUnknown
+)
+
+// Scheme is what the "sc" header tells the client to do after START. Schemes are compared with
+// ==, and the zero Scheme is SchemeAbsent
+type Scheme struct {
+	kind schemeKind
+
+	// raw is the value of an unknown scheme
+	raw string
+}
+
+var (
+	// SchemeAbsent is a message without the "sc" header. Setting it removes the header
+	SchemeAbsent = Scheme{kind: schemeAbsent}
+
+	// SchemeNone is the bare "sc" line, keeping the client in plain text. An empty "sc=" is
+	// parsed as SchemeNone too, but it's always set as a bare line
+	SchemeNone = Scheme{kind: schemeNone}
+
+	// SchemeTLS is "sc=tls", upgrading the connections to TLS after START. The value is matched
+	// without case
+	SchemeTLS = Scheme{kind: schemeTLS}
+)
+
+// SchemeUnknown returns the scheme of any other value of the "sc" header, like "tcp", which the
+// client is believed to treat as plain text
+func SchemeUnknown(raw string) Scheme {
+	return Scheme{kind: schemeUnknown, raw: raw}
+}
+
+// parseScheme returns the scheme of the value of an "sc" header, and whether there is one
+func parseScheme(value string, ok bool) Scheme {
+	switch {
+	case !ok:
+		return SchemeAbsent
+	case value == "":
+		return SchemeNone
+	case strings.EqualFold(value, "tls"):
+		return SchemeTLS
+	default:
+		return SchemeUnknown(value)
+	}
+}
+
+// IsTLS returns whether the scheme upgrades the connections to TLS
+func (s Scheme) IsTLS() bool {
+	return s.kind == schemeTLS
+}
+
+// String describes the scheme for logs: "absent", "none", "tls", or the quoted value of an
+// unknown scheme
+func (s Scheme) String() string {
+	switch s.kind {
+	case schemeNone:
+		return "none"
+	case schemeTLS:
+		return "tls"
+	case schemeUnknown:
+		return fmt.Sprintf("%q", s.raw)
+	default:
+		return "absent"
+	}
+}
+
+// Scheme returns the scheme the client is told to use with the "sc" header
+func (m *Message) Scheme() Scheme {
+	return parseScheme(m.Headers.Lookup(HeaderScheme))
+}
+
+// SetScheme sets the "sc" header to a scheme: SchemeNone as a bare "sc" line, SchemeTLS as
+// "sc=tls", and an unknown one with its value. SchemeAbsent removes the header. It returns an
+// error wrapping ErrInvalidHeader if the value of an unknown scheme can't be written
+func (m *Message) SetScheme(scheme Scheme) error {
+	switch scheme.kind {
+	case schemeNone:
+		return m.Headers.SetBare(HeaderScheme)
+	case schemeTLS:
+		return m.Headers.Set(HeaderScheme, "tls")
+	case schemeUnknown:
+		return m.Headers.Set(HeaderScheme, scheme.raw)
+	default:
+		m.Headers.Del(HeaderScheme)
+		return nil
+	}
+}
+
+// plaintextForClient returns the message to forward to the client. In client plaintext mode, the
+// "sc" header of a message telling the client to upgrade to TLS is cleared on a copy, and the
+// second value is true. This is done on every message, not only START like PONSE_DISABLE_TLS
+// used to, so the client never sees a TLS scheme. Otherwise the message is returned as is
+func plaintextForClient(res *Message) (*Message, bool) {
+	if !clientPlaintext || !res.Scheme().IsTLS() {
+		return res, false
+	}
+
+	forward := res.Clone()
+	forward.SetScheme(SchemeNone)
+	return forward, true
+}
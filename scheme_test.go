@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScheme(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		scheme Scheme
+	}{
+		{"sc=tls", "sc=tls\r\n", SchemeTLS},
+		{"sc=TLS", "sc=TLS\r\n", SchemeTLS},
+		{"bare sc", "sc\r\n", SchemeNone},
+		{"empty sc", "sc=\r\n", SchemeNone},
+		{"absent sc", "", SchemeAbsent},
+		{"unknown sc", "sc=tcp\r\n", SchemeUnknown("tcp")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := "iRTSP/1.21\r\nSeq=0\r\nRSP/START/200\r\n" + test.header + "t=1429051\r\nSubmit\r\n"
+			msg, err := NewMessage([]byte(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := msg.Scheme(); got != test.scheme {
+				t.Errorf("Scheme() = %s, want %s", got, test.scheme)
+			}
+			if got := msg.Scheme().IsTLS(); got != (test.scheme == SchemeTLS) {
+				t.Errorf("IsTLS() = %v for %s", got, test.scheme)
+			}
+		})
+	}
+}
+
+func TestSetScheme(t *testing.T) {
+	tests := []struct {
+		scheme Scheme
+		header string
+	}{
+		{SchemeTLS, "sc=tls\r\n"},
+		{SchemeNone, "sc\r\n"},
+		{SchemeAbsent, ""},
+		{SchemeUnknown("tcp"), "sc=tcp\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scheme.String(), func(t *testing.T) {
+			msg, err := NewMessage([]byte(testMessages[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := msg.SetScheme(test.scheme); err != nil {
+				t.Fatal(err)
+			}
+
+			// The header keeps its position
+			want := "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\n" + test.header + "t=1429051\r\nSubmit\r\n"
+			if got := string(msg.ToBytes()); got != want {
+				t.Errorf("ToBytes() = %q, want %q", got, want)
+			}
+
+			again, err := NewMessage(msg.ToBytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Scheme() != test.scheme {
+				t.Errorf("Scheme() after a round trip = %s, want %s", again.Scheme(), test.scheme)
+			}
+		})
+	}
+}
+
+func TestSetSchemeInvalid(t *testing.T) {
+	msg := NewResponse(MethodStart, 200)
+	if err := msg.SetScheme(SchemeUnknown("tls\r\nx")); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("SetScheme() of a value with a line ending error = %v, want ErrInvalidHeader", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// SequenceTracker follows the sequence numbers of the messages sent by one side of a control
+// connection, and reports the ones that don't follow the last one. The requests and responses
+// of a side are numbered separately, as a response carries the sequence of the request it
+// answers, so each type is tracked on its own
+type SequenceTracker struct {
+	// source is the side sending the messages, for the logs
+	source string
+
+	// last holds the sequence number and method of the last message of each type
+	last map[MessageType]trackedSequence
+
+	// Gaps counts the sequence numbers that jumped by more than one, Repeats the ones that
+	// were the same as the last one, and Backwards the ones lower than the last one
+	Gaps      int
+	Repeats   int
+	Backwards int
+
+	// Resets counts the sequence numbers that went back to zero, like when the console restarts
+	// the exchange. They aren't reported as anomalies
+	Resets int
+}
+
+// trackedSequence is the last message seen of a message type
+type trackedSequence struct {
+	sequence int
+	method   string
+}
+
+// newSequenceTracker creates the tracker of the messages sent by the given side. Each control
+// connection has its own trackers, so a new connection starts over without warnings
+func newSequenceTracker(source string) *SequenceTracker {
+	return &SequenceTracker{source: source, last: make(map[MessageType]trackedSequence)}
+}
+
+// observe checks the sequence number of a message against the last one of the same type
+func (t *SequenceTracker) observe(msg *Message) {
+	last, ok := t.last[msg.Type]
+	t.last[msg.Type] = trackedSequence{sequence: msg.Sequence, method: msg.Method}
+	if !ok {
+		return
+	}
+
+	var problem string
+	switch {
+	case msg.Sequence == last.sequence+1:
+		return
+	case msg.Sequence == 0:
+		t.Resets++
+		log.Printf("[%s] %s sequence reset to 0 by %s, the last one was %d (%s)\n", t.source, msg.Type, msg.Method, last.sequence, last.method)
+		return
+	case msg.Sequence == last.sequence:
+		t.Repeats++
+		problem = "repeated"
+	case msg.Sequence < last.sequence:
+		t.Backwards++
+		problem = "went backwards"
+	default:
+		t.Gaps++
+		problem = "skipped"
+	}
+
+	log.Printf("[ANOMALY] %s %s sequence %s: %d (%s) after %d (%s)\n", t.source, msg.Type, problem, msg.Sequence, msg.Method, last.sequence, last.method)
+}
+
+// Describe formats the counts of the tracker in a single line
+func (t *SequenceTracker) Describe() string {
+	return fmt.Sprintf("gaps=%d repeats=%d backwards=%d resets=%d", t.Gaps, t.Repeats, t.Backwards, t.Resets)
+}
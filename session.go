@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Session holds what has been negotiated so far on a proxied iRTSP connection
+type Session struct {
+	// ID identifies the control connection of the session
+	ID int64
+
+	// LogicalID is shared by the connections of a client reconnecting after an abnormal end
+	LogicalID int64
+
+	// Reconnects is the number of times the client reconnected within the logical session
+	Reconnects int
+
+	// Listener is the address the client connected to
+	Listener string
+
+	// Protocol follows the stage of the iRTSP exchange announced by the server
+	Protocol *ProtocolMachine
+
+	// Version is the iRTSP version used by the server
+	Version string
+
+	// Scheme is the scheme of the "sc" header sent by the server on START
+	Scheme Scheme
+
+	// ClientTLS is the TLS state of the client connection. It's nil if no TLS handshake was done
+	ClientTLS *tls.ConnectionState
+
+	// ServerTLS is the TLS state of the server connection. It's nil if no TLS handshake was done
+	ServerTLS *tls.ConnectionState
+
+	// Media maps each media kind (VIDEO, AUDIO, CONTROL) to the transport header advertised on SETUP
+	Media map[string]string
+
+	// Knock is the transport header of the KNOCK connection
+	Knock string
+
+	// HandshakeLatency is how long the TLS handshake with the server took
+	HandshakeLatency time.Duration
+
+	// Latency holds the time the proxy took to forward each message, keyed by the side
+	// that sent it (CLIENT or SERVER)
+	Latency map[string][]time.Duration
+
+	// ClientBytes counts the bytes of the client connection, on the wire and decrypted
+	ClientBytes ChannelBytes
+
+	// ServerBytes counts the bytes of the server connection, on the wire and decrypted
+	ServerBytes ChannelBytes
+
+	// ClientSequence and ServerSequence follow the sequence numbers of the messages of each side
+	ClientSequence *SequenceTracker
+	ServerSequence *SequenceTracker
+
+	// Ticks follows the "t" header of the messages of each side
+	Ticks *TickTracker
+
+	// RoundTrips pairs the requests of each side with their responses, and times them
+	RoundTrips *RoundTrips
+
+	// MaxHeaders is the largest number of headers seen in a message of either side
+	MaxHeaders int
+
+	// ResponseCodes counts the responses of the server by method and code
+	ResponseCodes ResponseCodes
+
+	// ErrorResponses is the number of responses of the server with an error code
+	ErrorResponses int
+
+	// EndReason is why the session ended. It's empty while the session is running
+	EndReason EndReason
+
+	// Escalation captures the control messages when something goes wrong. It's nil if no
+	// escalation trigger is configured
+	Escalation *escalation
+
+	// Timer is the countdown announced by the server. It's nil if no timer header is configured
+	Timer *SessionTimer
+}
+
+// NewSession creates an empty Session
+func NewSession() *Session {
+	session := &Session{
+		Media:          make(map[string]string),
+		Latency:        make(map[string][]time.Duration),
+		ResponseCodes:  make(ResponseCodes),
+		ClientSequence: newSequenceTracker("CLIENT"),
+		ServerSequence: newSequenceTracker("SERVER"),
+		RoundTrips:     newRoundTrips(),
+		Ticks:          newTickTracker(),
+		Protocol:       newProtocolMachine(),
+		Timer:          newSessionTimer(),
+	}
+	session.Escalation = newEscalation(session)
+
+	return session
+}
+
+// recordMedia records the transport header of a media kind announced by the server
+func (s *Session) recordMedia(kind, header string) {
+	if kind == "KNOCK" {
+		s.Knock = strings.TrimSuffix(header, ";")
+		return
+	}
+
+	s.Media[kind] = header
+}
+
+// Summary returns a single line describing everything negotiated on the session
+func (s *Session) Summary() string {
+	builder := &strings.Builder{}
+
+	builder.WriteString(fmt.Sprintf("session=%d connection=%d reconnects=%d", s.LogicalID, s.ID, s.Reconnects))
+	builder.WriteString(fmt.Sprintf(" listener=%s version=%s scheme=%s", s.Listener, s.Version, s.Scheme))
+	builder.WriteString(fmt.Sprintf(" protocol_state=%s", s.Protocol.State()))
+	builder.WriteString(" client_tls=" + describeTLS(s.ClientTLS))
+	builder.WriteString(" server_tls=" + describeTLS(s.ServerTLS))
+
+	// Keep the media kinds in a stable order
+	for _, kind := range []string{"VIDEO", "AUDIO", "CONTROL"} {
+		if header, ok := s.Media[kind]; ok {
+			builder.WriteString(fmt.Sprintf(" %s=%s", kind, header))
+			builder.WriteString(fmt.Sprintf("(%s)", relayStrategy(kind, mediaNetwork(header))))
+		}
+	}
+
+	if s.Timer != nil {
+		builder.WriteString(" time=" + s.Timer.Describe())
+	}
+
+	builder.WriteString(fmt.Sprintf(" error_responses=%d", s.ErrorResponses))
+
+	if s.Knock != "" {
+		builder.WriteString(" KNOCK=" + s.Knock)
+		builder.WriteString(fmt.Sprintf("(%s)", relayStrategy("KNOCK", mediaNetwork(s.Knock))))
+	}
+
+	return builder.String()
+}
+
+// LatencySummary returns a single line with the forwarding latency percentiles of each side
+func (s *Session) LatencySummary() string {
+	return fmt.Sprintf("client->server %s, server->client %s", describeLatency(s.Latency["CLIENT"]), describeLatency(s.Latency["SERVER"]))
+}
+
+// Stats returns the statistics of the session, one line each, logged when the session ends and
+// kept in its record for the bug report bundle
+func (s *Session) Stats() []string {
+	stats := []string{
+		"Proxy latency: " + s.LatencySummary(),
+		"Media relay pool: " + mediaPool.Stats(),
+		"Client bytes: " + s.ClientBytes.Describe(),
+		"Server bytes: " + s.ServerBytes.Describe(),
+		fmt.Sprintf("Sequence numbers: client %s, server %s", s.ClientSequence.Describe(), s.ServerSequence.Describe()),
+		"Round trips: " + s.RoundTrips.Describe(),
+		"Protocol state: " + s.Protocol.Describe(),
+		fmt.Sprintf("Most headers in a message: %d (limit %d)", s.MaxHeaders, maxHeaders),
+		fmt.Sprintf("Response codes: %s, %d errors (all sessions: %s)", s.ResponseCodes.Describe(), s.ErrorResponses, describeResponseCodes()),
+	}
+	if s.Timer != nil {
+		stats = append(stats, "Session time: "+s.Timer.Describe())
+	}
+
+	return stats
+}
+
+// recordLatency adds the forwarding time of a message sent by the given side
+func (s *Session) recordLatency(source string, latency time.Duration) {
+	s.Latency[source] = appendLatency(s.Latency[source], latency)
+}
+
+// observeHeaders keeps track of the largest number of headers seen in a message, to learn what
+// real traffic uses against the PONSE_MAX_HEADERS limit
+func (s *Session) observeHeaders(msg *Message) {
+	s.MaxHeaders = max(s.MaxHeaders, msg.Headers.Len())
+}
+
+// describeTLS formats the negotiated TLS version and cipher suite of a connection
+func describeTLS(state *tls.ConnectionState) string {
+	if state == nil {
+		return "none"
+	}
+
+	return tls.VersionName(state.Version) + "/" + tls.CipherSuiteName(state.CipherSuite)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedLogLines is the number of log lines the proxy keeps in memory, to store the lines
+// logged during each session with its record
+const recordedLogLines = 5000
+
+// maxSessionRecords is the number of ended sessions kept in the sessions file. The oldest
+// records are dropped first
+const maxSessionRecords = 20
+
+// logRecorder keeps the last lines logged by the proxy, numbered in the order they were logged.
+// The sessions share the log, so the lines of sessions running at the same time are mixed
+type logRecorder struct {
+	mutex sync.Mutex
+
+	// lines is a ring of the last recordedLogLines lines, the line numbered n being at
+	// n % recordedLogLines
+	lines []string
+
+	// next is the number of the next line logged
+	next int64
+}
+
+// proxyLog records the log of the proxy, once it's set as an output of the log package
+var proxyLog = &logRecorder{}
+
+// Write records the lines of a log entry. The log package writes each entry in a single call
+func (r *logRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if len(r.lines) < recordedLogLines {
+			r.lines = append(r.lines, line)
+		} else {
+			r.lines[r.next%recordedLogLines] = line
+		}
+		r.next++
+	}
+
+	return len(p), nil
+}
+
+// mark returns the number of the next line logged, to get the lines logged from now on with since
+func (r *logRecorder) mark() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.next
+}
+
+// since returns the lines logged since a mark, without the ones already dropped from the ring
+func (r *logRecorder) since(mark int64) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	first := max(mark, r.next-int64(len(r.lines)))
+	lines := make([]string, 0, r.next-first)
+	for n := first; n < r.next; n++ {
+		lines = append(lines, r.lines[n%recordedLogLines])
+	}
+
+	return lines
+}
+
+// SessionRecord is what the bug report bundle needs to know about an ended session
+type SessionRecord struct {
+	ID        int64     `json:"id"`
+	LogicalID int64     `json:"logical_id"`
+	Client    string    `json:"client"`
+	Listener  string    `json:"listener"`
+	Upstream  string    `json:"upstream"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EndReason EndReason `json:"end_reason"`
+	Error     string    `json:"error,omitempty"`
+
+	// Summary is the line of Session.Summary, and Stats the statistics logged when the session ended
+	Summary string   `json:"summary"`
+	Stats   []string `json:"stats"`
+
+	// Log are the lines logged during the session, mixed with the lines of the other sessions
+	// running at the same time
+	Log []string `json:"log"`
+}
+
+// sessionsMutex serializes the updates to the sessions file, as sessions can end concurrently
+var sessionsMutex sync.Mutex
+
+// sessionsPath returns the path of the sessions file. It can be set with the PONSE_SESSIONS_FILE
+// env, and defaults to sessions.json in the state directory
+func sessionsPath() (string, error) {
+	return stateFile("PONSE_SESSIONS_FILE", "sessions.json")
+}
+
+// loadSessionRecords reads the sessions file, oldest session first. A missing file has no sessions
+func loadSessionRecords() ([]SessionRecord, error) {
+	path, err := sessionsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []SessionRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// saveSessionRecord appends the record of an ended session to the sessions file, dropping the
+// oldest records past maxSessionRecords. The file is written through a temporary file, like the
+// upstream history
+func saveSessionRecord(record SessionRecord) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	records, err := loadSessionRecords()
+	if err != nil {
+		return err
+	}
+
+	records = append(records, record)
+	if len(records) > maxSessionRecords {
+		records = records[len(records)-maxSessionRecords:]
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := sessionsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// selectSessionRecords returns the records of a logical session, one per connection. The
+// selector is the session ID, as logged by the proxy, or "last" for the last session that ended
+func selectSessionRecords(records []SessionRecord, selector string) ([]SessionRecord, error) {
+	if len(records) == 0 {
+		return nil, errors.New("no session recorded yet")
+	}
+
+	logicalID := records[len(records)-1].LogicalID
+	if selector != "last" {
+		id, err := strconv.ParseInt(selector, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session %q: %w", selector, err)
+		}
+		logicalID = id
+	}
+
+	var selected []SessionRecord
+	for _, record := range records {
+		if record.LogicalID == logicalID {
+			selected = append(selected, record)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("session %d isn't in the last %d sessions recorded", logicalID, len(records))
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultMediaDrainTimeout is how long the media relays can keep running after the end of the
+// session, if PONSE_MEDIA_DRAIN_TIMEOUT isn't set
+const defaultMediaDrainTimeout = time.Second
+
+// mediaCloseTimeout is how long to wait for the relays to return once they are told to stop
+const mediaCloseTimeout = time.Second
+
+// mediaDrainTimeout returns the drain timeout, set with the PONSE_MEDIA_DRAIN_TIMEOUT env as a Go duration
+func mediaDrainTimeout() time.Duration {
+	if timeout := envDuration("PONSE_MEDIA_DRAIN_TIMEOUT"); timeout > 0 {
+		return timeout
+	}
+
+	return defaultMediaDrainTimeout
+}
+
+// mediaGroup holds the media connections of a session, so that they can be shut down in order
+// when the session ends. Closing the control connection to the server first makes it reset the
+// media connections, and the last moments of audio and video never reach the client
+type mediaGroup struct {
+	// accepting is canceled to close the media listeners
+	accepting     context.Context
+	stopAccepting context.CancelFunc
+
+	// relaying is canceled to stop the relays
+	relaying     context.Context
+	stopRelaying context.CancelFunc
+
+	// session is the ID of the session the media belongs to, and client and upstream are the
+	// IPs of its client and server
+	session  int64
+	client   string
+	upstream string
+
+	// mu orders the relays being tracked with the listeners being stopped, so that no relay
+	// is added once the shutdown waits for them. It also guards the connections
+	mu          sync.Mutex
+	relays      sync.WaitGroup
+	connections []*MediaConnection
+}
+
+// newMediaGroup creates the media group of a session, whose client connected from clientAddr
+// and whose server is at upstreamAddr
+func newMediaGroup(ctx context.Context, session int64, clientAddr, upstreamAddr net.Addr) *mediaGroup {
+	group := &mediaGroup{session: session, client: clientIP(clientAddr), upstream: clientIP(upstreamAddr)}
+	group.accepting, group.stopAccepting = context.WithCancel(ctx)
+	group.relaying, group.stopRelaying = context.WithCancel(ctx)
+	return group
+}
+
+// track counts a relay in the group, and returns it wrapped to be run. It returns false if the
+// group isn't accepting connections anymore, and the relay mustn't be run
+func (g *mediaGroup) track(relay func()) (func(), bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.accepting.Err() != nil {
+		return nil, false
+	}
+
+	g.relays.Add(1)
+	return func() {
+		defer g.relays.Done()
+		relay()
+	}, true
+}
+
+// wait waits for the relays to return for up to the given time, and returns whether they did
+func (g *mediaGroup) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.relays.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown ends the media connections of the session, before the control connections are
+// closed: it stops accepting new connections, lets the relays drain until the peers close them
+// or the drain timeout, and then stops the remaining relays
+func (g *mediaGroup) shutdown(session *Session) {
+	start := time.Now()
+	g.mu.Lock()
+	g.stopAccepting()
+	g.mu.Unlock()
+	log.Printf("[SESSION] Shutdown of session %d: stopped accepting media connections in %v\n", session.ID, time.Since(start))
+
+	stage := time.Now()
+	if g.wait(mediaDrainTimeout()) {
+		log.Printf("[SESSION] Shutdown of session %d: media relays drained in %v\n", session.ID, time.Since(stage))
+	} else {
+		stage = time.Now()
+		g.stopRelaying()
+		if g.wait(mediaCloseTimeout) {
+			log.Printf("[SESSION] Shutdown of session %d: media relays still running after the drain timeout, stopped in %v\n", session.ID, time.Since(stage))
+		} else {
+			log.Printf("[SESSION] Shutdown of session %d: media relays didn't stop within %v, closing the control connections anyway\n", session.ID, mediaCloseTimeout)
+		}
+	}
+
+	g.stopRelaying()
+	log.Printf("[SESSION] Shutdown of session %d: media done in %v, closing the control connections\n", session.ID, time.Since(start))
+	log.Printf("[SESSION] Media connections of session %d: %s\n", session.ID, g.describeConnections())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mediaSourcePort returns the local port to be used when dialing the server for the given
+// media kind, or 0 to let the system pick one.
+//
+// The ports are read from the PONSE_MEDIA_SOURCE_PORTS env as a comma-separated list of
+// KIND=PORT entries. A port starting with a sign is an offset from the source port of the
+// control connection instead. Example: VIDEO=40000,AUDIO=+1
+func mediaSourcePort(kind string, controlAddr net.Addr) (int, error) {
+	for _, entry := range strings.Split(os.Getenv("PONSE_MEDIA_SOURCE_PORTS"), ",") {
+		entryKind, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || !strings.EqualFold(entryKind, kind) {
+			continue
+		}
+
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid source port for %s: %w", kind, err)
+		}
+
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			tcpAddr, ok := controlAddr.(*net.TCPAddr)
+			if !ok {
+				return 0, fmt.Errorf("source port offset for %s needs a TCP control connection", kind)
+			}
+			port += tcpAddr.Port
+		}
+
+		if port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("source port %d for %s is out of range", port, kind)
+		}
+
+		return port, nil
+	}
+
+	return 0, nil
+}
+
+// mediaDialer creates the dialer used for the upstream media connections of the given kind,
+// binding it to the configured source port if there is one
+func mediaDialer(network, kind string, controlAddr net.Addr) (*net.Dialer, error) {
+	port, err := mediaSourcePort(kind, controlAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{}
+	if port == 0 {
+		return dialer, nil
+	}
+
+	// Allow the port to be reused right away, as a pinned port is dialed from every time
+	// the client opens a new media connection
+	dialer.Control = reuseAddrControl
+	if network == "udp" {
+		dialer.LocalAddr = &net.UDPAddr{Port: port}
+	} else {
+		dialer.LocalAddr = &net.TCPAddr{Port: port}
+	}
+
+	return dialer, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSpeedTestBitrate is the bitrate the media path is tested at, in kbit/s, if
+// PONSE_SPEEDTEST_BITRATE isn't set
+const defaultSpeedTestBitrate = 8000
+
+// speedTestDuration is how long the data is sent over each media path
+const speedTestDuration = 5 * time.Second
+
+// speedTestPacketSize is the size of the UDP packets and of the TCP writes, close to the media
+// chunks of the server
+const speedTestPacketSize = 1200
+
+// speedTestHeaderSize is the size of the sequence number and send time at the start of a UDP packet
+const speedTestHeaderSize = 16
+
+// runSpeedTest measures the round trip time to the destination server by timing the TCP
+// handshake against its control port. The connections are closed right away without sending
+// any iRTSP message, so no session is started on the server, but each of them is counted in
+// the connection budget like a session.
+//
+// The media path can't be measured against the real servers, as we can't send them arbitrary
+// data. If echoAddress is set, the throughput of a TCP stream and the loss and jitter of UDP
+// packets sent at the media bitrate are measured against an echo endpoint there instead, like
+// one started with `ponse speedtest serve`. The endpoint is dialed like the server, so whatever
+// VPN or tunnel is in the way is measured too
+func runSpeedTest(samples int, echoAddress string) error {
+	if err := measureControlRTT(samples); err != nil {
+		return err
+	}
+
+	if echoAddress == "" {
+		log.Println("[SPEEDTEST] No echo address, the media path isn't measured")
+		return nil
+	}
+
+	bitrate, err := speedTestBitrate()
+	if err != nil {
+		return err
+	}
+
+	if err := measureTCPThroughput(echoAddress, bitrate); err != nil {
+		return err
+	}
+
+	return measureUDPPath(echoAddress, bitrate)
+}
+
+// speedTestBitrate returns the bitrate of the media path test in kbit/s, set with the
+// PONSE_SPEEDTEST_BITRATE env
+func speedTestBitrate() (int, error) {
+	value := os.Getenv("PONSE_SPEEDTEST_BITRATE")
+	if value == "" {
+		return defaultSpeedTestBitrate, nil
+	}
+
+	bitrate, err := strconv.Atoi(value)
+	if err != nil || bitrate <= 0 {
+		return 0, fmt.Errorf("invalid PONSE_SPEEDTEST_BITRATE %q", value)
+	}
+
+	return bitrate, nil
+}
+
+// measureControlRTT times the TCP handshakes against the control port of the server. It stops
+// when the connection budget is used up
+func measureControlRTT(samples int) error {
+	rtts := make([]time.Duration, 0, samples)
+	for i := 0; i < samples; i++ {
+		if err := reserveUpstreamAttempt(); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		conn, err := net.DialTimeout(serverNetwork, serverControlAddress, 5*time.Second)
+		if err != nil {
+			log.Printf("[SPEEDTEST] Sample %d: %v\n", i+1, fmt.Errorf("%w: %w", ErrUpstreamDial, err))
+			continue
+		}
+		rtt := time.Since(start)
+		conn.Close()
+
+		log.Printf("[SPEEDTEST] Sample %d: %v\n", i+1, rtt)
+		rtts = append(rtts, rtt)
+
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if len(rtts) == 0 {
+		return fmt.Errorf("%w: all %d samples failed", ErrUpstreamDial, samples)
+	}
+
+	minRTT, maxRTT, total := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		minRTT = min(minRTT, rtt)
+		maxRTT = max(maxRTT, rtt)
+		total += rtt
+	}
+
+	loss := float64(samples-len(rtts)) / float64(samples) * 100
+	log.Printf("[SPEEDTEST] %s: min=%v avg=%v max=%v jitter=%v loss=%.0f%%\n", serverControlAddress, minRTT, total/time.Duration(len(rtts)), maxRTT, meanJitter(rtts), loss)
+
+	return nil
+}
+
+// meanJitter is the mean difference between consecutive samples
+func meanJitter(samples []time.Duration) time.Duration {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	var jitter time.Duration
+	for i := 1; i < len(samples); i++ {
+		diff := samples[i] - samples[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		jitter += diff
+	}
+
+	return jitter / time.Duration(len(samples)-1)
+}
+
+// paceSend calls send with the number of the next chunk, as fast as needed to keep up with the
+// bitrate in kbit/s, for speedTestDuration. It returns the number of chunks sent
+func paceSend(bitrate int, send func(n int) error) (int, error) {
+	start := time.Now()
+	bytesPerSecond := float64(bitrate) * 1000 / 8
+
+	sent := 0
+	for time.Since(start) < speedTestDuration {
+		due := int(time.Since(start).Seconds() * bytesPerSecond / speedTestPacketSize)
+		if sent >= due {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if err := send(sent); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// measureTCPThroughput sends a TCP stream at the bitrate to the echo endpoint, and measures the
+// bandwidth of the stream echoed back
+func measureTCPThroughput(echoAddress string, bitrate int) error {
+	conn, err := net.DialTimeout("tcp", echoAddress, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("speed test echo endpoint: %w", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var received int64
+	var lastByte time.Time
+	done := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				received += int64(n)
+				lastByte = time.Now()
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	chunk := make([]byte, speedTestPacketSize)
+	sent, err := paceSend(bitrate, func(int) error {
+		_, err := writeFull(conn, chunk)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("speed test TCP stream: %w", err)
+	}
+
+	// Let the echo catch up, then stop reading
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := <-done; !errors.Is(err, io.EOF) {
+		log.Printf("[SPEEDTEST] TCP stream didn't end cleanly: %v\n", err)
+	}
+
+	if received == 0 {
+		return fmt.Errorf("speed test TCP stream: nothing echoed by %s", echoAddress)
+	}
+
+	achieved := float64(received) * 8 / 1000 / lastByte.Sub(start).Seconds()
+	log.Printf("[SPEEDTEST] TCP %s: target=%d kbit/s achieved=%.0f kbit/s echoed=%d/%d bytes\n", echoAddress, bitrate, achieved, received, int64(sent)*speedTestPacketSize)
+
+	return nil
+}
+
+// measureUDPPath sends numbered UDP packets at the bitrate to the echo endpoint, and measures the
+// loss, the round trip time and the jitter of the packets echoed back
+func measureUDPPath(echoAddress string, bitrate int) error {
+	conn, err := net.Dial("udp", echoAddress)
+	if err != nil {
+		return fmt.Errorf("speed test echo endpoint: %w", err)
+	}
+	defer conn.Close()
+
+	var mutex sync.Mutex
+	seen := make(map[uint64]bool)
+	var rtts []time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, speedTestPacketSize)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			if n < speedTestHeaderSize {
+				continue
+			}
+
+			seq := binary.BigEndian.Uint64(buffer)
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(buffer[8:])))
+
+			mutex.Lock()
+			if !seen[seq] {
+				seen[seq] = true
+				rtts = append(rtts, time.Since(sentAt))
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	packet := make([]byte, speedTestPacketSize)
+	sent, err := paceSend(bitrate, func(n int) error {
+		binary.BigEndian.PutUint64(packet, uint64(n))
+		binary.BigEndian.PutUint64(packet[8:], uint64(time.Now().UnixNano()))
+		_, err := conn.Write(packet)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("speed test UDP packets: %w", err)
+	}
+
+	// Packets still in flight after a second are lost
+	time.Sleep(time.Second)
+	conn.Close()
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loss := float64(sent-len(rtts)) / float64(sent) * 100
+	if len(rtts) == 0 {
+		log.Printf("[SPEEDTEST] UDP %s: sent=%d received=0 loss=100%%\n", echoAddress, sent)
+		return nil
+	}
+
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	log.Printf("[SPEEDTEST] UDP %s: sent=%d received=%d loss=%.1f%% rtt=%v jitter=%v\n", echoAddress, sent, len(rtts), loss, total/time.Duration(len(rtts)), meanJitter(rtts))
+
+	return nil
+}
+
+// serveSpeedTestEcho echoes back the TCP streams and UDP packets sent to the address, as the
+// endpoint of the media path test. It runs until the process is stopped
+func serveSpeedTestEcho(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer packetConn.Close()
+
+	log.Printf("[SPEEDTEST] Echoing TCP and UDP on %s\n", address)
+
+	go func() {
+		buffer := make([]byte, 64*1024)
+		for {
+			n, addr, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				log.Printf("[SPEEDTEST] UDP echo stopped: %v\n", err)
+				return
+			}
+			packetConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// submitLine is the line ending every message
+var submitLine = []byte("Submit")
+
+// SplitSubmit is a bufio.SplitFunc splitting a stream into whole messages, for tools reading
+// captures or raw sockets with a bufio.Scanner. Each token is a message as received, up to and
+// including the line ending of its Submit line, which is found the same way as MessageReader
+// does. More data is requested while the Submit line isn't complete, so a terminator split
+// across reads is found once the rest arrives.
+//
+// At the end of the stream, a last message whose Submit line has no line ending is returned as
+// is, and anything else left fails the scan with an error wrapping ErrTruncatedMessage. Messages
+// larger than the buffer of the scanner, 64 KiB by default, fail it with bufio.ErrTooLong
+func SplitSubmit(data []byte, atEOF bool) (int, []byte, error) {
+	for start := 0; start < len(data); {
+		i := bytes.IndexByte(data[start:], '\n')
+		if i < 0 {
+			break
+		}
+
+		end := start + i + 1
+		if bytes.Equal(bytes.TrimRight(data[start:end], "\r\n"), submitLine) {
+			return end, data[:end], nil
+		}
+		start = end
+	}
+
+	if !atEOF || len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	// Like NewMessage, a Submit line cut after its CR is truncated
+	lastLine := data[bytes.LastIndexByte(data, '\n')+1:]
+	if bytes.Equal(lastLine, submitLine) {
+		return len(data), data, nil
+	}
+
+	return 0, nil, fmt.Errorf("%w: %d bytes without a Submit line", ErrTruncatedMessage, len(data))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// scanMessages splits a stream with SplitSubmit, reading it one byte at a time
+func scanMessages(stream string) ([]string, error) {
+	scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(stream)))
+	scanner.Split(SplitSubmit)
+
+	var messages []string
+	for scanner.Scan() {
+		messages = append(messages, scanner.Text())
+	}
+
+	return messages, scanner.Err()
+}
+
+func TestSplitSubmit(t *testing.T) {
+	lf := "iRTSP/1.21\nSeq=3\nSET/OPTIONS\n\nbody with Submit inside\nSubmit\n"
+	fixture := append(append([]string(nil), testMessages...), lf)
+
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"messages", strings.Join(fixture, ""), fixture},
+		{"last Submit without a line ending", testMessages[0] + strings.TrimSuffix(testMessages[1], "\r\n"), []string{testMessages[0], strings.TrimSuffix(testMessages[1], "\r\n")}},
+		{"empty stream", "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, err := scanMessages(test.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(messages, "|") != strings.Join(test.want, "|") {
+				t.Errorf("tokens = %q, want %q", messages, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitSubmitTruncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"cut in the headers", testMessages[0] + testMessages[1][:30]},
+		{"cut in the Submit line", testMessages[0] + testMessages[1][:len(testMessages[1])-5]},
+		{"Submit line with CR only", testMessages[0] + testMessages[1][:len(testMessages[1])-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, err := scanMessages(test.stream)
+			if !errors.Is(err, ErrTruncatedMessage) {
+				t.Errorf("Err() = %v, want ErrTruncatedMessage", err)
+			}
+			if len(messages) != 1 || messages[0] != testMessages[0] {
+				t.Errorf("tokens = %q, want the first message", messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// tickSample is a tick seen on a message, with when the message arrived
+type tickSample struct {
+	tick    time.Duration
+	arrived time.Time
+}
+
+// TickTracker follows the "t" header of the messages of each side, to check whether it counts
+// milliseconds. Each tick is compared with the previous one of the same side, and the difference
+// with the time elapsed between both messages is logged as the drift
+type TickTracker struct {
+	// last is the last tick seen, by side
+	last map[string]tickSample
+}
+
+// newTickTracker creates an empty TickTracker
+func newTickTracker() *TickTracker {
+	return &TickTracker{last: make(map[string]tickSample)}
+}
+
+// observe logs the tick of a message read by the proxy, if it has one, and how much it moved
+// since the previous message of the same side
+func (t *TickTracker) observe(msg *Message) {
+	tick, ok := msg.Tick()
+	if !ok {
+		if value, found := msg.Headers.Lookup(HeaderTime); found {
+			log.Printf("[%s] Invalid tick %s=%q on %s\n", msg.Direction, HeaderTime, value, msg.Method)
+		}
+		return
+	}
+
+	previous, ok := t.last[msg.Direction]
+	t.last[msg.Direction] = tickSample{tick: tick, arrived: msg.Timestamp}
+	if !ok {
+		log.Printf("[%s] First tick %s=%d on %s\n", msg.Direction, HeaderTime, tick.Milliseconds(), msg.Method)
+		return
+	}
+
+	moved := tick - previous.tick
+	elapsed := msg.Timestamp.Sub(previous.arrived).Round(time.Millisecond)
+	log.Printf("[%s] Tick %s=%d on %s moved by %v in %v (drift %v)\n", msg.Direction, HeaderTime, tick.Milliseconds(), msg.Method, moved, elapsed, moved-elapsed)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTimerWarnings are the remaining times at which a warning is logged
+var defaultTimerWarnings = []time.Duration{5 * time.Minute, time.Minute}
+
+// SessionTimer tracks a countdown announced by the server. Which header carries it hasn't been
+// confirmed yet, so its name and unit are configurable. The raw values are logged every time
+// they are seen, so the interpretation can be checked against the captures
+type SessionTimer struct {
+	// Header is the name of the header holding the countdown
+	Header string
+
+	// Unit is the duration of one unit of the countdown value
+	Unit time.Duration
+
+	// Value is the last value seen
+	Value int64
+
+	// SeenAt is when the last value was seen. It's zero if no value was seen yet
+	SeenAt time.Time
+
+	// warnings are the remaining times still to be warned about, largest first
+	warnings []time.Duration
+}
+
+// newSessionTimer creates the timer configured with the PONSE_TIMER_HEADER, PONSE_TIMER_UNIT
+// (a Go duration, "1s" by default) and PONSE_TIMER_WARNINGS (comma-separated Go durations,
+// "5m,1m" by default) envs. It returns nil if no header is configured
+func newSessionTimer() *SessionTimer {
+	header := os.Getenv("PONSE_TIMER_HEADER")
+	if header == "" {
+		return nil
+	}
+
+	timer := &SessionTimer{Header: header, Unit: time.Second, warnings: slices.Clone(defaultTimerWarnings)}
+
+	if value := os.Getenv("PONSE_TIMER_UNIT"); value != "" {
+		unit, err := time.ParseDuration(value)
+		if err != nil || unit <= 0 {
+			log.Printf("Invalid PONSE_TIMER_UNIT %q, using %v\n", value, timer.Unit)
+		} else {
+			timer.Unit = unit
+		}
+	}
+
+	if value := os.Getenv("PONSE_TIMER_WARNINGS"); value != "" {
+		timer.warnings = nil
+		for _, entry := range strings.Split(value, ",") {
+			warning, err := time.ParseDuration(strings.TrimSpace(entry))
+			if err != nil {
+				log.Printf("Invalid PONSE_TIMER_WARNINGS entry %q: %v\n", entry, err)
+				continue
+			}
+			timer.warnings = append(timer.warnings, warning)
+		}
+	}
+
+	// Warn about the largest remaining time first
+	slices.Sort(timer.warnings)
+	slices.Reverse(timer.warnings)
+
+	return timer
+}
+
+// Observe updates the timer with the headers of a server message
+func (t *SessionTimer) Observe(headers *Headers) {
+	raw, ok := headers.Lookup(t.Header)
+	if !ok {
+		return
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		log.Printf("[TIMER] Non-numeric %s value %q\n", t.Header, raw)
+		return
+	}
+
+	if !t.SeenAt.IsZero() && value > t.Value {
+		log.Printf("[TIMER] %s went up from %d to %d\n", t.Header, t.Value, value)
+	}
+
+	t.Value = value
+	t.SeenAt = time.Now()
+	log.Printf("[TIMER] %s=%d (%s)\n", t.Header, value, t.Describe())
+
+	remaining := t.Remaining()
+	for len(t.warnings) > 0 && remaining <= t.warnings[0] {
+		log.Printf("[TIMER] WARNING: less than %v of session time left\n", t.warnings[0])
+		t.warnings = t.warnings[1:]
+	}
+}
+
+// Remaining estimates the time left, counting down from when the last value was seen
+func (t *SessionTimer) Remaining() time.Duration {
+	remaining := time.Duration(t.Value)*t.Unit - time.Since(t.SeenAt)
+	return max(remaining, 0)
+}
+
+// Describe formats the estimated time left
+func (t *SessionTimer) Describe() string {
+	if t.SeenAt.IsZero() {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("~%v left", t.Remaining().Round(time.Second))
+}
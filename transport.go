@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UnknownTransportPolicy is what the proxy does when the server announces media over a
+// transport protocol other than "tcp" or "ust"
+type UnknownTransportPolicy string
+
+const (
+	// TransportPassthrough forwards the header unchanged, without relaying the media
+	TransportPassthrough UnknownTransportPolicy = "passthrough"
+
+	// TransportRewrite announces the media to the client over TCP, and relays it to the
+	// server over TCP too, as the best the proxy can do without knowing the protocol. The
+	// server is dialed over TCP whatever it announced, so the relay only works if it also
+	// accepts TCP on the port
+	TransportRewrite UnknownTransportPolicy = "rewrite"
+
+	// TransportFail answers the client with an error response instead of the message
+	TransportFail UnknownTransportPolicy = "fail"
+)
+
+// unknownTransportPolicy returns the policy for unknown transports, set with the
+// PONSE_UNKNOWN_TRANSPORT env. It's passthrough by default
+func unknownTransportPolicy() UnknownTransportPolicy {
+	value := os.Getenv("PONSE_UNKNOWN_TRANSPORT")
+	switch policy := UnknownTransportPolicy(strings.ToLower(value)); policy {
+	case TransportPassthrough, TransportRewrite, TransportFail:
+		return policy
+	case "":
+		return TransportPassthrough
+	default:
+		log.Printf("Invalid PONSE_UNKNOWN_TRANSPORT %q, using %s\n", value, TransportPassthrough)
+		return TransportPassthrough
+	}
+}
+
+// TransportInfo is a media transport header announced by the server, like
+// "iDataChunk/unicast/tcp/40603"
+type TransportInfo struct {
+	// StreamType is the streaming type, like "iDataChunk"
+	StreamType string
+
+	// Delivery is the delivery type. Only "unicast" is supported
+	Delivery string
+
+	// Protocol is the transport protocol, "tcp" or "ust"
+	Protocol string
+
+	// Port is the server port
+	Port int
+
+	// Extra are the sections between the delivery type and the protocol, if a header ever has
+	// more than four. They are kept so that the header is formatted back as it came
+	Extra []string
+}
+
+// ParseTransport parses a media transport header. The KNOCK header ends with a ";", which isn't
+// part of the port. Sections added in the middle by a future header are kept in Extra, the
+// protocol and the port always being the last two
+func ParseTransport(header string) (TransportInfo, error) {
+	sections := strings.Split(strings.TrimSuffix(header, ";"), "/")
+	if len(sections) < 4 {
+		return TransportInfo{}, fmt.Errorf("invalid media transport %q: expected 4 sections, got %d", header, len(sections))
+	}
+
+	last := len(sections) - 1
+	transport := TransportInfo{
+		StreamType: sections[0],
+		Delivery:   sections[1],
+		Protocol:   sections[last-1],
+		Extra:      sections[2 : last-1],
+	}
+	if len(transport.Extra) == 0 {
+		transport.Extra = nil
+	}
+
+	if sections[last] == "" {
+		return TransportInfo{}, fmt.Errorf("invalid media transport %q: missing port", header)
+	}
+	port, err := strconv.Atoi(sections[last])
+	if err != nil || port <= 0 || port > 65535 {
+		return TransportInfo{}, fmt.Errorf("invalid media transport %q: invalid port %q", header, sections[last])
+	}
+	transport.Port = port
+
+	if transport.Delivery != "unicast" {
+		return TransportInfo{}, fmt.Errorf("unsupported media transport %q: %s delivery can't be relayed", header, transport.Delivery)
+	}
+
+	return transport, nil
+}
+
+// String formats the transport as a header, without the ";" of the KNOCK header
+func (t TransportInfo) String() string {
+	sections := append([]string{t.StreamType, t.Delivery}, t.Extra...)
+	sections = append(sections, t.Protocol, strconv.Itoa(t.Port))
+	return strings.Join(sections, "/")
+}
+
+// Known returns whether the proxy knows how to relay the transport protocol, from the protocol
+// registry
+func (t TransportInfo) Known() bool {
+	return knownProtocolValue(KindTransport, t.Protocol)
+}
+
+// Network returns the network the transport is relayed over. UST is a custom network protocol
+// over UDP, used as a "slow connection" mode, but its payload is the same as in TCP mode
+func (t TransportInfo) Network() string {
+	if t.Protocol == "ust" {
+		return "udp"
+	}
+
+	return t.Protocol
+}
+
+// applyTransportPolicy checks the media headers of a server message for unknown transports, and
+// applies the policy to them. It returns the message to relay the media of and forward, with a
+// description of the change for the audit log. The message is res itself and the description
+// empty if it wasn't changed. Otherwise the transports are rewritten to TCP on a copy, so that
+// the message as received stays available, and the media are relayed over TCP on both sides.
+// The error wraps ErrUnknownTransport if the policy is to fail, in which case the message
+// mustn't be forwarded
+func applyTransportPolicy(res *Message) (*Message, string, error) {
+	forward := res
+	var changed []string
+	for _, announced := range methodInfo(res.Method).Media {
+		key := announced.Header
+		for _, header := range res.Headers.Values(key) {
+			transport, err := ParseTransport(header)
+			if err != nil {
+				continue
+			}
+			observeProtocol(KindTransport, transport.Protocol)
+			if transport.Known() {
+				continue
+			}
+
+			policy := unknownTransportPolicy()
+			log.Printf("[ANOMALY] Unknown transport %q in %s header %s=%s (policy %s)\n", transport.Protocol, res.Method, key, header, policy)
+
+			switch policy {
+			case TransportFail:
+				return nil, "", fmt.Errorf("%w: %q in %s header %s=%s", ErrUnknownTransport, transport.Protocol, res.Method, key, header)
+			case TransportRewrite:
+				transport.Protocol = "tcp"
+				rewritten := transport.String()
+				if strings.HasSuffix(header, ";") {
+					rewritten += ";"
+				}
+				if forward == res {
+					forward = res.Clone()
+				}
+				if err := forward.Headers.Replace(key, header, rewritten); err != nil {
+					return nil, "", err
+				}
+				changed = append(changed, fmt.Sprintf("%s=%s", key, rewritten))
+			}
+		}
+	}
+
+	if len(changed) == 0 {
+		return res, "", nil
+	}
+
+	return forward, "unknown transport rewritten to tcp (" + strings.Join(changed, ", ") + ")", nil
+}
+
+// transportFailure returns the error response sent to the client instead of a message announcing
+// media over an unknown transport, when the policy is to fail
+func transportFailure(res *Message) *Message {
+	failure := NewResponse(res.Method, defaultRefusalCode)
+	failure.Version = res.Version
+	failure.Sequence = res.Sequence
+	return failure
+}
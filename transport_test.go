@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestApplyTransportPolicy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	unknown := "iRTSP/1.21\r\nSeq=1\r\nRSP/SETUP/200\r\nv=iDataChunk/unicast/quic/40603\r\na=iDataChunk/unicast/tcp/40603\r\nc=iDataChunk/unicast/tcp/40605\r\nSubmit\r\n"
+
+	tests := []struct {
+		name    string
+		raw     string
+		policy  string
+		changed bool
+		video   string
+		err     error
+	}{
+		{"known transport", testMessages[1], "rewrite", false, "iDataChunk/unicast/tcp/40603", nil},
+		{"passthrough", unknown, "passthrough", false, "iDataChunk/unicast/quic/40603", nil},
+		{"rewrite", unknown, "rewrite", true, "iDataChunk/unicast/tcp/40603", nil},
+		{"fail", unknown, "fail", false, "", ErrUnknownTransport},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PONSE_UNKNOWN_TRANSPORT", test.policy)
+			res, err := NewMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			forward, description, err := applyTransportPolicy(res)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("applyTransportPolicy() error = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if (forward != res) != test.changed || (description != "") != test.changed {
+				t.Errorf("applyTransportPolicy() copied=%v description=%q, want changed=%v", forward != res, description, test.changed)
+			}
+			if got := forward.Headers.Get(HeaderVideo); got != test.video {
+				t.Errorf("forwarded v = %q, want %q", got, test.video)
+			}
+
+			// The message as received is never changed
+			if got := string(res.ToBytes()); got != test.raw {
+				t.Errorf("received message changed to %q", got)
+			}
+		})
+	}
+}
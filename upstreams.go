@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxHistorySamples is the number of latency and duration samples kept per upstream. Older
+// samples are dropped so the history file doesn't grow forever
+const maxHistorySamples = 100
+
+// UpstreamHistory holds the reliability aggregates of a single destination server
+type UpstreamHistory struct {
+	// Dials is the number of attempts to connect to the server
+	Dials int `json:"dials"`
+
+	// DialFailures is the number of attempts that failed to connect
+	DialFailures int `json:"dial_failures"`
+
+	// CleanSessions is the number of sessions closed by either side without errors
+	CleanSessions int `json:"clean_sessions"`
+
+	// ErrorSessions is the number of sessions that ended with an error of the server, in its
+	// TLS handshake or while reading from or writing to it
+	ErrorSessions int `json:"error_sessions"`
+
+	// OtherErrorSessions is the number of sessions that ended with an error of the client or of
+	// the proxy, which doesn't count against the server
+	OtherErrorSessions int `json:"other_error_sessions"`
+
+	// HandshakeLatencies are the most recent TLS handshake times with the server
+	HandshakeLatencies []time.Duration `json:"handshake_latencies"`
+
+	// SessionDurations are the most recent session durations
+	SessionDurations []time.Duration `json:"session_durations"`
+
+	// LastSeen is the time the last session with the server ended
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// historyMutex serializes the updates to the history file, as sessions can end concurrently
+var historyMutex sync.Mutex
+
+// historyPath returns the path of the upstream history file. It can be set with the
+// PONSE_HISTORY_FILE env, and defaults to upstreams.json in the state directory
+func historyPath() (string, error) {
+	return stateFile("PONSE_HISTORY_FILE", "upstreams.json")
+}
+
+// loadHistory reads the upstream history file. A missing file is an empty history
+func loadHistory() (map[string]*UpstreamHistory, error) {
+	history := make(map[string]*UpstreamHistory)
+
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// saveHistory writes the upstream history file. The data is written to a temporary file first,
+// so that a crash can't leave a truncated history behind
+func saveHistory(history map[string]*UpstreamHistory) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// recordUpstreamSession updates the history of the upstream with the outcome of a session.
+// err is the error the session ended with, and duration how long the session lasted
+func recordUpstreamSession(upstream string, session *Session, duration time.Duration, err error) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	history, loadErr := loadHistory()
+	if loadErr != nil {
+		return loadErr
+	}
+
+	entry, ok := history[upstream]
+	if !ok {
+		entry = &UpstreamHistory{}
+		history[upstream] = entry
+	}
+
+	entry.Dials++
+	entry.LastSeen = time.Now()
+
+	// A failed dial never became a session, so there is nothing else to record
+	if errors.Is(err, ErrUpstreamDial) {
+		entry.DialFailures++
+		return saveHistory(history)
+	}
+
+	// The session loop only returns on errors. Either side closing the connection is
+	// treated as a clean teardown, and only the failures of the server count against it
+	switch {
+	case errors.Is(err, io.EOF):
+		entry.CleanSessions++
+	case upstreamFault(err):
+		entry.ErrorSessions++
+	default:
+		entry.OtherErrorSessions++
+	}
+
+	if session.HandshakeLatency > 0 {
+		entry.HandshakeLatencies = appendSample(entry.HandshakeLatencies, session.HandshakeLatency)
+	}
+	entry.SessionDurations = appendSample(entry.SessionDurations, duration)
+
+	return saveHistory(history)
+}
+
+// upstreamFault returns whether a session ended with a failure of the server: its TLS handshake,
+// reading from or writing to it, or a message from it the proxy can't handle. A handshake fails on
+// the side it's wrapped with, so a client refusing TLS isn't charged to the server
+func upstreamFault(err error) bool {
+	if errors.Is(err, ErrClientConnection) || errors.Is(err, ErrClientParse) {
+		return false
+	}
+
+	return errors.Is(err, ErrHandshake) || errors.Is(err, ErrUpstreamConnection) || errors.Is(err, ErrServerParse)
+}
+
+// appendSample adds a sample to the list, dropping the oldest ones past maxHistorySamples
+func appendSample(samples []time.Duration, sample time.Duration) []time.Duration {
+	samples = append(samples, sample)
+	if len(samples) > maxHistorySamples {
+		samples = samples[len(samples)-maxHistorySamples:]
+	}
+
+	return samples
+}
+
+// percentile returns the p-th percentile (0-100) of the samples, or 0 if there are none
+func percentile(samples []time.Duration, p int) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// printUpstreamsReport prints the reliability history of every upstream, the most recently
+// used first
+func printUpstreamsReport() error {
+	history, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		path, _ := historyPath()
+		fmt.Printf("No upstream history in %s\n", path)
+		return nil
+	}
+
+	upstreams := make([]string, 0, len(history))
+	for upstream := range history {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		return history[upstreams[i]].LastSeen.After(history[upstreams[j]].LastSeen)
+	})
+
+	for _, upstream := range upstreams {
+		entry := history[upstream]
+		successRate := float64(entry.Dials-entry.DialFailures) / float64(entry.Dials) * 100
+
+		fmt.Printf("%s (last seen %s)\n", upstream, entry.LastSeen.Format(time.RFC3339))
+		fmt.Printf("  dials: %d (%.0f%% successful)\n", entry.Dials, successRate)
+		fmt.Printf("  sessions: %d clean, %d errors, %d client or proxy errors\n", entry.CleanSessions, entry.ErrorSessions, entry.OtherErrorSessions)
+		fmt.Printf("  handshake: median=%v\n", percentile(entry.HandshakeLatencies, 50))
+		fmt.Printf("  duration: p10=%v median=%v p90=%v\n",
+			percentile(entry.SessionDurations, 10),
+			percentile(entry.SessionDurations, 50),
+			percentile(entry.SessionDurations, 90))
+	}
+
+	return nil
+}
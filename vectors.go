@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// defaultVectorsDir is where the conformance vectors are written if no directory is given
+const defaultVectorsDir = "testdata/vectors"
+
+// conformanceVectors are the raw messages the vectors are generated from, by name. They cover
+// the edge cases of the message format, so that other implementations can check that they
+// parse and serialize messages the same way as the proxy
+var conformanceVectors = map[string]string{
+	"request":           "iRTSP/1.21\r\nSeq=0\r\nSET/OPTIONS\r\nSubmit\r\n",
+	"response":          "iRTSP/1.21\r\nSeq=1\r\nRSP/OPTIONS/200\r\nSubmit\r\n",
+	"flag-headers":      "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc\r\nt=1429051\r\nSubmit\r\n",
+	"empty-value":       "iRTSP/1.21\r\nSeq=0\r\nSET/START\r\nsc=\r\nt=1429051\r\nSubmit\r\n",
+	"duplicate-header":  "iRTSP/1.21\r\nSeq=2\r\nSET/SETUP\r\nport=41003\r\nport=41004\r\nSubmit\r\n",
+	"header-order":      "iRTSP/1.21\r\nSeq=3\r\nSET/SETUP\r\nz=1\r\na=2\r\nm=3\r\nSubmit\r\n",
+	"ambiguous-header":  "iRTSP/1.21\r\nSeq=4\r\nSET/SETUP\r\na2V5=x=1\r\nSubmit\r\n",
+	"missing-seq":       "iRTSP/1.21\r\nSET/OPTIONS\r\nSubmit\r\n",
+	"body-lines":        "iRTSP/1.21\r\nSeq=5\r\nRSP/SETUP/200\r\nport=41003\r\n\r\nfree text\r\nSubmit\r\n",
+	"lf-endings":        "iRTSP/1.21\nSeq=6\nSET/OPTIONS\nt=1\nSubmit\n",
+	"mixed-endings":     "iRTSP/1.21\nSeq=7\r\nSET/OPTIONS\nt=1\r\nSubmit\n",
+	"no-final-ending":   "iRTSP/1.21\r\nSeq=8\r\nSET/OPTIONS\r\nSubmit",
+	"incomplete":        "iRTSP/1.21\r\nSeq=9\r\nSET/START\r\nsc\r\n",
+	"empty":             "",
+	"version-only":      "iRTSP/1.21\r\nSubmit\r\n",
+	"invalid-seq":       "iRTSP/1.21\r\nSeq=abc\r\nSET/OPTIONS\r\nSubmit\r\n",
+	"invalid-code":      "iRTSP/1.21\r\nSeq=10\r\nRSP/OPTIONS/OK\r\nSubmit\r\n",
+	"garbage":           "\x16\x03\x01\x00\x05hello",
+	"submit-only":       "Submit\r\n",
+	"line-ending-only":  "\r\n",
+	"missing-method":    "iRTSP/1.21\r\nSeq=11\r\nt=1\r\nSubmit\r\n",
+	"empty-method":      "iRTSP/1.21\r\nSeq=12\r\nSET/\r\nSubmit\r\n",
+	"missing-code":      "iRTSP/1.21\r\nSeq=13\r\nRSP/OPTIONS\r\nSubmit\r\n",
+	"control-character": "iRTSP/1.21\r\nSeq=14\r\nSET/OPTIONS\r\nt=1\x00\r\nSubmit\r\n",
+	"invalid-revision":  "iRTSP/1.x\r\nSeq=15\r\nSET/OPTIONS\r\nSubmit\r\n",
+	"padded-header":     "iRTSP/1.21\r\nSeq=16\r\nSET/START\r\nsc \r\n t =1429051\r\nSubmit\r\n",
+	"equals-in-value":   "iRTSP/1.21\r\nSeq=17\r\nSET/SETUP\r\nu=key=val;other=2\r\nSubmit\r\n",
+	"binary-body":       "iRTSP/1.21\r\nSeq=18\r\nRSP/SETUP/200\r\nport=41003\r\n\r\n\x00\x01\xfe\xff\n\x1f\x8b\r\nSubmit\r\n",
+	"empty-body":        "iRTSP/1.21\r\nSeq=19\r\nRSP/SETUP/200\r\nport=41003\r\n\r\nSubmit\r\n",
+}
+
+// VectorMessage is the parsed form of a message in a conformance vector
+type VectorMessage struct {
+	Version  string         `json:"version"`
+	Sequence int            `json:"seq"`
+	Method   string         `json:"method"`
+	Code     int            `json:"code"`
+	Headers  []VectorHeader `json:"headers,omitempty"`
+
+	// Body is the body in base64, missing if the message has none. It's empty for a message
+	// with a delimiter and nothing after it
+	Body *[]byte `json:"body,omitempty"`
+
+	// Invalid is set when the message can't be parsed. It's then forwarded as received
+	Invalid bool `json:"invalid,omitempty"`
+
+	// StrictInvalid is set when the message can only be parsed leniently, like the proxy does.
+	// Strict parsing rejects it
+	StrictInvalid bool `json:"strict_invalid,omitempty"`
+}
+
+// VectorHeader is a header field in a conformance vector, in the order of the message
+type VectorHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+
+	// Bare is set when the line has no equal sign, to tell "sc" from "sc="
+	Bare bool `json:"bare,omitempty"`
+}
+
+// vectorFiles returns the parsed form and the re-serialized bytes of a raw message. Messages are
+// re-serialized with the original line endings, as they are when forwarded unchanged, and
+// invalid messages are forwarded as received
+func vectorFiles(raw []byte) ([]byte, []byte, error) {
+	vector := VectorMessage{Invalid: true}
+	serialized := raw
+
+	msg, err := NewMessage(raw)
+	if err == nil {
+		vector = VectorMessage{
+			Version:  msg.Version,
+			Sequence: msg.Sequence,
+			Method:   msg.Method,
+			Code:     msg.Code,
+		}
+		for _, field := range msg.Headers.Fields() {
+			vector.Headers = append(vector.Headers, VectorHeader{Key: field.Key, Value: field.Value, Bare: !field.HasValue})
+		}
+		if msg.Body != nil {
+			vector.Body = &msg.Body
+		}
+		serialized = msg.Serialize(true)
+
+		_, err = ParseMessage(raw, ParseOptions{Strict: true})
+		vector.StrictInvalid = err != nil
+	}
+
+	parsed, err := json.MarshalIndent(vector, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(parsed, '\n'), serialized, nil
+}
+
+// generateVectors writes every conformance vector to a directory, as three files: the raw
+// message (<name>.raw), its parsed form (<name>.json) and the re-serialized bytes (<name>.out)
+func generateVectors(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, raw := range conformanceVectors {
+		parsed, serialized, err := vectorFiles([]byte(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		files := map[string][]byte{".raw": []byte(raw), ".json": parsed, ".out": serialized}
+		for extension, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name+extension), data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("Wrote %d vectors to %s\n", len(conformanceVectors), dir)
+	return nil
+}
+
+// verifyVectors parses every raw message of a vectors directory, and checks that the parsed
+// form and the re-serialized bytes match the expected files
+func verifyVectors(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.raw"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no vectors found in %s", dir)
+	}
+
+	var errs []error
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".raw")
+		if err := verifyVector(strings.TrimSuffix(path, ".raw")); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	for _, err := range errs {
+		fmt.Printf("FAIL %v\n", err)
+	}
+	fmt.Printf("%d/%d vectors passed\n", len(paths)-len(errs), len(paths))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d vectors failed", len(errs))
+	}
+
+	return nil
+}
+
+// verifyVector checks a single vector, given the path of its files without the extension
+func verifyVector(path string) error {
+	raw, err := os.ReadFile(path + ".raw")
+	if err != nil {
+		return err
+	}
+
+	expectedParsed, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return err
+	}
+
+	expectedSerialized, err := os.ReadFile(path + ".out")
+	if err != nil {
+		return err
+	}
+
+	parsed, serialized, err := vectorFiles(raw)
+	if err != nil {
+		return err
+	}
+
+	// Compare the decoded forms, so that the expected JSON can be formatted freely
+	var expected, actual VectorMessage
+	if err := json.Unmarshal(expectedParsed, &expected); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parsed, &actual); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		return fmt.Errorf("parsed as %s", parsed)
+	}
+
+	if !bytes.Equal(expectedSerialized, serialized) {
+		return fmt.Errorf("serialized as %q, expected %q", serialized, expectedSerialized)
+	}
+
+	return nil
+}
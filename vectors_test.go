@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestVectors checks the parser and the serializer against every vector of testdata/vectors, a
+// vector being the .raw message with the .json of its parsed form and the .out of its
+// serialized form
+func TestVectors(t *testing.T) {
+	entries, err := os.ReadDir(defaultVectorsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := make(map[string][]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext)
+		sets[name] = append(sets[name], ext)
+	}
+	if len(sets) == 0 {
+		t.Fatalf("no vectors in %s", defaultVectorsDir)
+	}
+
+	for name, exts := range sets {
+		t.Run(name, func(t *testing.T) {
+			if strings.Join(exts, " ") != ".json .out .raw" {
+				t.Fatalf("vector has the files %v, want .json, .out and .raw", exts)
+			}
+
+			if err := verifyVector(filepath.Join(defaultVectorsDir, name)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
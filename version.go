@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is a parsed version line, like "iRTSP/1.21". The line is kept as received in
+// Message.Version for serialization
+type ProtocolVersion struct {
+	// Protocol is the protocol name, "iRTSP"
+	Protocol string
+
+	// Major and Minor are the numbers of the revision, 1 and 21 in "iRTSP/1.21"
+	Major int
+	Minor int
+}
+
+// ParseVersion parses a version line. It returns an error if the line isn't an iRTSP version or
+// its revision isn't two numbers separated by a dot
+func ParseVersion(line string) (ProtocolVersion, error) {
+	protocol, revision, found := strings.Cut(line, "/")
+	if !found || protocol != "iRTSP" {
+		return ProtocolVersion{}, fmt.Errorf("not an iRTSP version: %q", line)
+	}
+
+	major, minor, found := strings.Cut(revision, ".")
+	if !found {
+		return ProtocolVersion{}, fmt.Errorf("invalid iRTSP revision %q", revision)
+	}
+
+	version := ProtocolVersion{Protocol: protocol}
+	var err error
+	if version.Major, err = strconv.Atoi(major); err != nil {
+		return ProtocolVersion{}, fmt.Errorf("invalid iRTSP revision %q: %w", revision, err)
+	}
+	if version.Minor, err = strconv.Atoi(minor); err != nil {
+		return ProtocolVersion{}, fmt.Errorf("invalid iRTSP revision %q: %w", revision, err)
+	}
+
+	return version, nil
+}
+
+// AtLeast returns whether the version is the given revision or a later one
+func (v ProtocolVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v ProtocolVersion) String() string {
+	return fmt.Sprintf("%s/%d.%d", v.Protocol, v.Major, v.Minor)
+}
+
+// ProtocolVersion returns the parsed version of the message, and whether it could be parsed
+func (m *Message) ProtocolVersion() (ProtocolVersion, bool) {
+	version, err := ParseVersion(m.Version)
+	return version, err == nil
+}
+
+// VersionAtLeast returns whether the message is of the given revision or a later one. It's
+// false if the version can't be parsed, as nothing can be assumed of the peer then
+func (m *Message) VersionAtLeast(major, minor int) bool {
+	version, ok := m.ProtocolVersion()
+	return ok && version.AtLeast(major, minor)
+}